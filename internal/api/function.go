@@ -0,0 +1,387 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/salehborhani/403Unlocker-cli/internal/check"
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+	"github.com/salehborhani/403Unlocker-cli/internal/dns"
+	"github.com/salehborhani/403Unlocker-cli/internal/docker"
+	"github.com/salehborhani/403Unlocker-cli/internal/history"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	DEFAULT_LISTEN         = "127.0.0.1:9404"
+	DEFAULT_MAX_CONCURRENT = 2
+	DEFAULT_TIMEOUT        = 10
+	MAX_TIMEOUT            = 60
+)
+
+// CheckRequest is the body of POST /check.
+type CheckRequest struct {
+	URL string `json:"url"`
+}
+
+// BestDNSRequest is the body of POST /bestdns.
+type BestDNSRequest struct {
+	URL     string `json:"url"`
+	Timeout int    `json:"timeout,omitempty"`
+	Check   bool   `json:"check,omitempty"`
+	// CacheTTL is how many seconds the checked DNS cache is trusted,
+	// dns.DEFAULT_CACHE_TTL when 0.
+	CacheTTL int `json:"cache_ttl,omitempty"`
+	// Refresh checks the DNS servers again even when the cache is valid.
+	Refresh bool `json:"refresh,omitempty"`
+	// CheckTimeout limits each check request in seconds, the API's
+	// --check-timeout when 0.
+	CheckTimeout int `json:"check_timeout,omitempty"`
+}
+
+// FastDockerRequest is the body of POST /fastdocker.
+type FastDockerRequest struct {
+	Image   string `json:"image"`
+	Timeout int    `json:"timeout,omitempty"`
+	// Platform such as linux/arm64, docker.DefaultPlatform when empty.
+	Platform string `json:"platform,omitempty"`
+	// Digest is the manifest digest registries must serve, like --digest.
+	Digest string `json:"digest,omitempty"`
+	// Reference is the trusted registry the digest is resolved from when
+	// Digest is empty, like --reference. The image's own registry by default.
+	Reference string `json:"reference,omitempty"`
+}
+
+// ServerResult is the result of one DNS server or registry.
+type ServerResult struct {
+	Server         string  `json:"server"`
+	OK             bool    `json:"ok"`
+	StatusCode     int     `json:"status_code,omitempty"`
+	Status         string  `json:"status,omitempty"`
+	LatencyMillis  float64 `json:"latency_ms,omitempty"`
+	BytesPerSecond int64   `json:"bytes_per_second,omitempty"`
+	Error          string  `json:"error,omitempty"`
+}
+
+// Response is returned by every probing endpoint.
+type Response struct {
+	Target string `json:"target"`
+	// Digest is the manifest digest registries were verified against.
+	Digest  string         `json:"digest,omitempty"`
+	Best    string         `json:"best,omitempty"`
+	Results []ServerResult `json:"results"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Server answers probe requests over HTTP.
+type Server struct {
+	token    string
+	slots    chan struct{}
+	timeouts common.Timeouts
+}
+
+// NewServer returns a Server that requires token (unless empty), runs at
+// most maxConcurrent probes at a time and checks URLs with timeouts.
+func NewServer(token string, maxConcurrent int, timeouts common.Timeouts) *Server {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	return &Server{token: token, slots: make(chan struct{}, maxConcurrent), timeouts: timeouts}
+}
+
+// Handler returns the HTTP handler of the API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/check", s.probe(s.check))
+	mux.HandleFunc("/bestdns", s.probe(s.bestDNS))
+	mux.HandleFunc("/fastdocker", s.probe(s.fastDocker))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	return mux
+}
+
+// probe wraps a probing endpoint with method, auth and concurrency checks.
+func (s *Server) probe(handle func(r *http.Request) (*Response, int, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSON(w, http.StatusMethodNotAllowed, errorResponse{"only POST is allowed"})
+			return
+		}
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, errorResponse{"missing or invalid token"})
+			return
+		}
+		select {
+		case s.slots <- struct{}{}:
+			defer func() { <-s.slots }()
+		default:
+			writeJSON(w, http.StatusTooManyRequests, errorResponse{"too many probes running, try again later"})
+			return
+		}
+
+		resp, status, err := handle(r)
+		if err != nil {
+			writeJSON(w, status, errorResponse{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.token == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func (s *Server) check(r *http.Request) (*Response, int, error) {
+	var req CheckRequest
+	if err := decode(r, &req); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if !check.DomainValidator(req.URL) {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid url %q", req.URL)
+	}
+	dnsList, err := common.ReadOrDownloadConfig(common.DNS_CONFIG_FILE, common.DNS_CONFIG_URL)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	url := check.EnsureHTTPS(req.URL)
+	started := time.Now()
+	results := check.Probe(r.Context(), url, dnsList, s.timeouts, nil)
+	check.RecordHistory(r.Context(), history.KIND_CHECK, url, started, results)
+
+	resp := &Response{Target: url, Results: make([]ServerResult, 0, len(results))}
+	var fastest time.Duration
+	for _, result := range results {
+		sr := ServerResult{
+			Server:        result.Server,
+			OK:            result.OK(),
+			StatusCode:    result.StatusCode,
+			Status:        result.Status,
+			LatencyMillis: float64(result.Latency.Microseconds()) / 1000,
+		}
+		if result.Err != nil {
+			sr.Error = result.Err.Error()
+		}
+		if result.OK() && (resp.Best == "" || result.Latency < fastest) {
+			resp.Best, fastest = result.Server, result.Latency
+		}
+		resp.Results = append(resp.Results, sr)
+	}
+	return resp, http.StatusOK, nil
+}
+
+func (s *Server) bestDNS(r *http.Request) (*Response, int, error) {
+	var req BestDNSRequest
+	if err := decode(r, &req); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if !dns.URLValidator(req.URL) {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid url %q", req.URL)
+	}
+	timeout, err := timeoutOf(req.Timeout)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	ttl := dns.DEFAULT_CACHE_TTL
+	switch {
+	case req.CacheTTL < 0:
+		return nil, http.StatusBadRequest, errors.New("cache_ttl must not be negative")
+	case req.CacheTTL > 0:
+		ttl = time.Duration(req.CacheTTL) * time.Second
+	}
+	timeouts := s.timeouts
+	if req.CheckTimeout != 0 {
+		if timeouts.Request, err = timeoutOf(req.CheckTimeout); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("check_timeout must be between 1 and %d seconds", MAX_TIMEOUT)
+		}
+	}
+
+	var dnsList []string
+	if req.Check {
+		dnsList, err = dns.ValidCachedDNS(r.Context(), req.URL, ttl, req.Refresh, timeouts, io.Discard)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if len(dnsList) == 0 {
+			return nil, http.StatusBadGateway, fmt.Errorf("no DNS server passed the check against %s", dns.CacheDomain(req.URL))
+		}
+	} else {
+		dnsList, err = common.ReadOrDownloadConfig(common.DNS_CONFIG_FILE, common.DNS_CONFIG_URL)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+	}
+
+	started := time.Now()
+	sizes := dns.Benchmark(r.Context(), req.URL, dnsList, timeout, common.DownloadOptions{}, nil)
+	dns.RecordBenchmark(r.Context(), req.URL, started, timeout, sizes)
+
+	resp := &Response{Target: req.URL, Results: make([]ServerResult, 0, len(sizes))}
+	resp.Best, _ = dns.Best(sizes)
+	for _, server := range dnsList {
+		size := sizes[server]
+		resp.Results = append(resp.Results, ServerResult{
+			Server:         server,
+			OK:             size > 0,
+			BytesPerSecond: int64(float64(size) / timeout.Seconds()),
+		})
+	}
+	return resp, http.StatusOK, nil
+}
+
+func (s *Server) fastDocker(r *http.Request) (*Response, int, error) {
+	var req FastDockerRequest
+	if err := decode(r, &req); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if !docker.DockerImageValidator(req.Image) {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid image %q", req.Image)
+	}
+	timeout, err := timeoutOf(req.Timeout)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	platform := docker.DefaultPlatform()
+	if req.Platform != "" {
+		parsed, err := v1.ParsePlatform(req.Platform)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid platform %q", req.Platform)
+		}
+		platform = *parsed
+	}
+	registries, err := docker.ReadRegistries()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// Like fastdocker, every registry is asked for the same manifest by
+	// digest. When the trusted registry cannot be reached only the layers
+	// are verified.
+	resp := &Response{Target: req.Image}
+	pullName := req.Image
+	expected, _, err := docker.ResolveDigest(r.Context(), req.Image, req.Digest, req.Reference, registries, timeout)
+	switch {
+	case errors.Is(err, common.ErrInvalidInput):
+		return nil, http.StatusBadRequest, err
+	case err == nil:
+		if pullName, err = docker.Pin(req.Image, expected); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		resp.Digest = expected.String()
+	}
+
+	started := time.Now()
+	results := docker.Benchmark(r.Context(), pullName, platform, registries, timeout, common.DownloadOptions{}, nil)
+	docker.RecordHistory(r.Context(), req.Image, started, timeout, results)
+
+	resp.Results = make([]ServerResult, 0, len(results))
+	resp.Best, _ = docker.Best(results)
+	for _, result := range results {
+		sr := ServerResult{
+			Server:         result.Registry,
+			OK:             result.Err == nil && result.Bytes > 0,
+			LatencyMillis:  float64(result.Phases.Manifest.Microseconds()) / 1000,
+			BytesPerSecond: int64(float64(result.Bytes) / timeout.Seconds()),
+		}
+		if result.Untrusted() {
+			sr.Status = "untrusted"
+		}
+		if result.Err != nil {
+			sr.Error = result.Err.Error()
+		}
+		resp.Results = append(resp.Results, sr)
+	}
+	return resp, http.StatusOK, nil
+}
+
+func timeoutOf(seconds int) (time.Duration, error) {
+	switch {
+	case seconds == 0:
+		return DEFAULT_TIMEOUT * time.Second, nil
+	case seconds < 0 || seconds > MAX_TIMEOUT:
+		return 0, fmt.Errorf("timeout must be between 1 and %d seconds", MAX_TIMEOUT)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+func decode(r *http.Request, v any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<16))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// IsLoopback reports whether the listen address addr only accepts
+// connections from this host.
+func IsLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Serve runs the API until interrupted.
+func Serve(c *cli.Context) error {
+	ctx := c.Context
+
+	token, listen := c.String("token"), c.String("listen")
+	if token == "" {
+		log.Println("Warning: no --token set, anyone who can reach the API on this host can run probes")
+	}
+	api := NewServer(token, c.Int("max-concurrent"), check.TimeoutsFlag(c, "check-timeout"))
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           api.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		// Cancel running probes when the API is interrupted.
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Printf("Serving API on %s\n", server.Addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerRejectsRequests(t *testing.T) {
+	handler := NewServer("secret", 1, common.DefaultTimeouts).Handler()
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		token    string
+		body     string
+		expected int
+	}{
+		{"Wrong method", http.MethodGet, "/check", "secret", "", http.StatusMethodNotAllowed},
+		{"Missing token", http.MethodPost, "/check", "", `{"url":"pkg.go.dev"}`, http.StatusUnauthorized},
+		{"Wrong token", http.MethodPost, "/check", "guess", `{"url":"pkg.go.dev"}`, http.StatusUnauthorized},
+		{"Invalid JSON", http.MethodPost, "/check", "secret", `{"url":`, http.StatusBadRequest},
+		{"Unknown field", http.MethodPost, "/check", "secret", `{"domain":"pkg.go.dev"}`, http.StatusBadRequest},
+		{"Invalid URL", http.MethodPost, "/bestdns", "secret", `{"url":"ftp://example.com"}`, http.StatusBadRequest},
+		{"Timeout too long", http.MethodPost, "/bestdns", "secret", `{"url":"https://example.com","timeout":3600}`, http.StatusBadRequest},
+		{"Negative cache TTL", http.MethodPost, "/bestdns", "secret", `{"url":"https://example.com","check":true,"cache_ttl":-1}`, http.StatusBadRequest},
+		{"Check timeout too long", http.MethodPost, "/bestdns", "secret", `{"url":"https://example.com","check":true,"check_timeout":3600}`, http.StatusBadRequest},
+		{"Invalid image", http.MethodPost, "/fastdocker", "secret", `{"image":"Invalid!Image"}`, http.StatusBadRequest},
+		{"Unknown endpoint", http.MethodPost, "/nothing", "secret", `{}`, http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			assert.Equal(t, tt.expected, recorder.Code, "Test case: %s", tt.name)
+		})
+	}
+}
+
+func TestServerConcurrencyLimit(t *testing.T) {
+	server := NewServer("", 1, common.DefaultTimeouts)
+	handler := server.Handler()
+
+	// Occupy the only slot as a running probe would.
+	server.slots <- struct{}{}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/check", strings.NewReader(`{"url":"pkg.go.dev"}`)))
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+
+	<-server.slots
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/check", strings.NewReader(`{"url":"invalid"}`)))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+func TestIsLoopback(t *testing.T) {
+	for addr, expected := range map[string]bool{
+		DEFAULT_LISTEN:   true,
+		"localhost:9404": true,
+		"[::1]:9404":     true,
+		":9404":          false,
+		"0.0.0.0:9404":   false,
+		"10.0.0.5:9404":  false,
+		"9404":           false,
+	} {
+		assert.Equal(t, expected, IsLoopback(addr), addr)
+	}
+}
@@ -1,6 +1,13 @@
 package check
 
 import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -122,8 +129,42 @@ func TestEnsureHTTPS(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := ensureHTTPS(tt.url)
+			result := EnsureHTTPS(tt.url)
 			assert.Equal(t, tt.expected, result, "Test case: %s", tt.name)
 		})
 	}
 }
+
+func TestResultReason(t *testing.T) {
+	tests := []struct {
+		name     string
+		result   Result
+		expected string
+	}{
+		{"OK", Result{StatusCode: 200, Status: "OK"}, ""},
+		{"Forbidden", Result{StatusCode: 403, Status: "Forbidden"}, "HTTP 403"},
+		{"No such host", Result{Err: &url.Error{Op: "Get", Err: &net.DNSError{Err: "no such host", IsNotFound: true}}}, "DNS: no such host"},
+		{"DNS timeout", Result{Err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}}, "DNS timeout"},
+		{"Timeout", Result{Err: &url.Error{Op: "Get", Err: context.DeadlineExceeded}}, "timeout"},
+		{"Refused", Result{Err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}, "connection refused"},
+		{"Reset", Result{Err: &url.Error{Op: "Get", Err: io.EOF}}, "connection reset"},
+		{"TLS", Result{Err: errors.New("tls: handshake failure")}, "TLS handshake failed"},
+		{"Other", Result{Err: errors.New("something else")}, "something else"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.result.Reason(), "Test case: %s", tt.name)
+		})
+	}
+}
+
+func TestSummary(t *testing.T) {
+	results := []Result{
+		{Server: "1", StatusCode: 200, Status: "OK"},
+		{Server: "2", StatusCode: 403, Status: "Forbidden"},
+		{Server: "3", StatusCode: 403, Status: "Forbidden"},
+		{Server: "4", Status: "Error", Err: errors.New("timeout")},
+	}
+	assert.Equal(t, "1 unlocked, 2 blocked, 1 unreachable", Summary(results))
+}
@@ -1,78 +1,293 @@
 package check
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/salehborhani/403Unlocker-cli/internal/common"
+	"github.com/salehborhani/403Unlocker-cli/internal/history"
+	"github.com/salehborhani/403Unlocker-cli/internal/network"
 	"github.com/urfave/cli/v2"
 )
 
-func CheckWithDNS(c *cli.Context) error {
-	url := c.Args().First()
-	url = ensureHTTPS(url)
+// Result is the outcome of requesting a URL through one DNS server.
+type Result struct {
+	Server     string
+	StatusCode int
+	Status     string
+	Latency    time.Duration
+	Err        error
+}
 
-	fmt.Println("URL: ", url)
+// OK reports whether the server could reach the URL without a 403 or any other error status.
+func (r Result) OK() bool {
+	return r.Err == nil && r.StatusCode == http.StatusOK
+}
 
-	// Print header
-	fmt.Println("\n+--------------------+------------+")
-	fmt.Printf("| %-18s | %-10s |\n", "DNS Server", "Status")
-	fmt.Println("+--------------------+------------+")
+// Outcomes of a Result, used for the summary line.
+const (
+	OUTCOME_UNLOCKED    = "unlocked"
+	OUTCOME_BLOCKED     = "blocked"
+	OUTCOME_UNREACHABLE = "unreachable"
+)
 
-	dnsList, err := common.ReadDNSFromFile(common.DNS_CONFIG_FILE)
-	if err != nil {
-		err = common.DownloadConfigFile(common.DNS_CONFIG_URL, common.DNS_CONFIG_FILE)
-		if err != nil {
-			return err
+// Outcome reports whether the server reached the URL, got another status
+// (usually 403) or could not reach it at all.
+func (r Result) Outcome() string {
+	switch {
+	case r.OK():
+		return OUTCOME_UNLOCKED
+	case r.Err == nil:
+		return OUTCOME_BLOCKED
+	}
+	return OUTCOME_UNREACHABLE
+}
+
+// Reason explains in a few words why the server did not reach the URL.
+func (r Result) Reason() string {
+	if r.Err == nil {
+		if r.OK() {
+			return ""
 		}
+		return fmt.Sprintf("HTTP %d", r.StatusCode)
+	}
 
-		dnsList, err = common.ReadDNSFromFile(common.DNS_CONFIG_FILE)
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	switch {
+	case errors.Is(r.Err, context.Canceled):
+		return "interrupted"
+	case errors.As(r.Err, &dnsErr):
+		if dnsErr.IsTimeout {
+			return "DNS timeout"
+		}
+		if dnsErr.IsNotFound {
+			return "DNS: no such host"
+		}
+		return "DNS lookup failed"
+	case errors.Is(r.Err, context.DeadlineExceeded), errors.As(r.Err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(r.Err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(r.Err, syscall.ECONNRESET), errors.Is(r.Err, io.EOF), errors.Is(r.Err, io.ErrUnexpectedEOF):
+		return "connection reset"
+	case errors.Is(r.Err, syscall.ENETUNREACH), errors.Is(r.Err, syscall.EHOSTUNREACH):
+		return "network unreachable"
+	case errors.As(r.Err, &certErr), errors.As(r.Err, &recordErr), strings.Contains(r.Err.Error(), "tls:"):
+		return "TLS handshake failed"
+	}
+	return r.Err.Error()
+}
+
+// Summary counts results per outcome, e.g. "5 unlocked, 12 blocked, 7 unreachable".
+func Summary(results []Result) string {
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result.Outcome()]++
+	}
+	return fmt.Sprintf("%d %s, %d %s, %d %s",
+		counts[OUTCOME_UNLOCKED], OUTCOME_UNLOCKED,
+		counts[OUTCOME_BLOCKED], OUTCOME_BLOCKED,
+		counts[OUTCOME_UNREACHABLE], OUTCOME_UNREACHABLE)
+}
 
-		if err != nil {
-			fmt.Println(err)
-			return err
+// Table returns results as a table with one row per server, failed ones included.
+func Table(results []Result) *common.Table {
+	table := common.NewTable("DNS Server", "Status", "Reason")
+	for _, result := range results {
+		color := common.Red
+		switch result.Outcome() {
+		case OUTCOME_UNLOCKED:
+			color = common.Green
+		case OUTCOME_UNREACHABLE:
+			color = common.Yellow
 		}
+		table.AddRow(common.Plain(result.Server), common.Colored(color, result.Status), common.Plain(result.Reason()))
 	}
+	return table
+}
+
+// ProbeDNS requests url through dns, limited by timeouts and ctx.
+func ProbeDNS(ctx context.Context, dns, url string, timeouts common.Timeouts) Result {
+	result := Result{Server: dns}
+	client := common.NewDNSClient(dns, timeouts)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		result.Status = "Error"
+		result.Err = err
+		return result
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	result.Latency = time.Since(start)
+	if err != nil {
+		result.Status = "Error"
+		result.Err = err
+		return result
+	}
+	defer resp.Body.Close()
+
+	code := strings.SplitN(resp.Status, " ", 2)
+	if len(code) < 2 {
+		result.Status = "Invalid"
+		result.Err = fmt.Errorf("invalid status line %q", resp.Status)
+		return result
+	}
+	statusCodeInt, err := strconv.Atoi(code[0])
+	if err != nil {
+		result.Status = "Error"
+		result.Err = fmt.Errorf("error converting status code: %w", err)
+		return result
+	}
+	result.StatusCode = statusCodeInt
+	result.Status = code[1]
+	return result
+}
 
+// Probe requests url through every server in dnsList concurrently. onResult,
+// if not nil, is called as soon as each server finishes. When ctx is
+// cancelled, the servers still running finish with context.Canceled.
+func Probe(ctx context.Context, url string, dnsList []string, timeouts common.Timeouts, onResult func(Result)) []Result {
 	var wg sync.WaitGroup
+	var mu sync.Mutex
+	results := make([]Result, 0, len(dnsList))
 	for _, dns := range dnsList {
 		wg.Add(1)
 		go func(dns string) {
 			defer wg.Done()
-			client := common.ChangeDNS(dns)
-			resp, err := client.Get(url)
-			if err != nil {
-				return
-			}
-			defer resp.Body.Close()
-			code := strings.Split(resp.Status, " ")
-			statusCodeInt, err := strconv.Atoi(code[0])
-			if err != nil {
-				fmt.Println("Error converting status code:", err)
-				return
-			}
+			result := ProbeDNS(ctx, dns, url, timeouts)
 
-			// Format table row with colored status
-			if statusCodeInt != http.StatusOK {
-				fmt.Printf("| %-18s | %s%-10s%s |\n", dns, common.Red, code[1], common.Reset)
-			} else {
-				fmt.Printf("| %-18s | %s%-10s%s |\n", dns, common.Green, code[1], common.Reset)
+			mu.Lock()
+			defer mu.Unlock()
+			results = append(results, result)
+			if onResult != nil {
+				onResult(result)
 			}
-
 		}(dns)
 	}
 	wg.Wait()
+	return results
+}
 
-	// Print footer
-	fmt.Println("+--------------------+------------+")
+// RecordHistory stores results of probing url in the history database.
+// Probes cut short by an interrupt say nothing about the server and are skipped.
+func RecordHistory(ctx context.Context, kind, url string, started time.Time, results []Result) {
+	networkID := network.Current(ctx).ID()
+	measurements := make([]history.Measurement, 0, len(results))
+	for _, result := range results {
+		if errors.Is(result.Err, context.Canceled) {
+			continue
+		}
+		measurements = append(measurements, history.Measurement{
+			Time:    started,
+			Kind:    kind,
+			Target:  parsedHost(url),
+			Server:  result.Server,
+			Network: networkID,
+			OK:      result.OK(),
+			Status:  result.Status,
+		})
+	}
+	if err := history.Append(measurements...); err != nil {
+		fmt.Println("Warning: could not save history:", err)
+	}
+}
+
+// SortResults orders results with working servers first, then servers that
+// answered with another status, then errors; each group by latency and server.
+func SortResults(results []Result) {
+	rank := func(r Result) int {
+		switch {
+		case r.OK():
+			return 0
+		case r.Err == nil:
+			return 1
+		}
+		return 2
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if rank(a) != rank(b) {
+			return rank(a) < rank(b)
+		}
+		if a.Latency != b.Latency {
+			return a.Latency < b.Latency
+		}
+		return a.Server < b.Server
+	})
+}
+
+// TimeoutsFlag returns the probe timeouts given in seconds with the flag named
+// request, --dial-timeout and --dns-timeout.
+func TimeoutsFlag(c *cli.Context, request string) common.Timeouts {
+	return common.Timeouts{
+		Request: time.Duration(c.Int(request)) * time.Second,
+		Dial:    time.Duration(c.Int("dial-timeout")) * time.Second,
+		DNS:     time.Duration(c.Int("dns-timeout")) * time.Second,
+	}
+}
+
+// CheckWithDNS prints the status of the URL in the first argument through every configured DNS server.
+func CheckWithDNS(c *cli.Context) error {
+	url := c.Args().First()
+	url = EnsureHTTPS(url)
+
+	fmt.Println("URL: ", url)
+
+	dnsList, err := common.ReadOrDownloadConfig(common.DNS_CONFIG_FILE, common.DNS_CONFIG_URL)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Checking %d DNS servers...\n\n", len(dnsList))
+
+	timeouts := TimeoutsFlag(c, "timeout")
+	started := time.Now()
+	done := 0
+	results := Probe(c.Context, url, dnsList, timeouts, func(Result) {
+		done++
+		common.Progress("Checked", done, len(dnsList))
+	})
+	SortResults(results)
+
+	Table(results).Print()
+	fmt.Println(Summary(results))
+
+	RecordHistory(c.Context, history.KIND_CHECK, url, started, results)
+
+	if err := common.Interrupted(c.Context); err != nil {
+		return err
+	}
+	if c.Bool("fail-if-none") && !anyOK(results) {
+		return fmt.Errorf("%w: no DNS server could reach %s", common.ErrNoneWorked, url)
+	}
 	return nil
 }
 
+func anyOK(results []Result) bool {
+	for _, result := range results {
+		if result.OK() {
+			return true
+		}
+	}
+	return false
+}
+
 func DomainValidator(domain string) bool {
 	domainRegex := `^(http[s]?:\/\/)?([a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*\.[a-zA-Z]{2,}).*?$`
 	match, _ := regexp.MatchString(domainRegex, domain)
@@ -94,7 +309,8 @@ func DomainValidator(domain string) bool {
 	return true
 }
 
-func ensureHTTPS(URL string) string {
+// EnsureHTTPS reduces URL to https://<host>/, which is what check requests.
+func EnsureHTTPS(URL string) string {
 	// Regex to check if the URL starts with https://
 	regexHTTPS := `^(https)://`
 	reHTTPS, err := regexp.Compile(regexHTTPS)
@@ -123,3 +339,12 @@ func ensureHTTPS(URL string) string {
 	// Return only the scheme and host (e.g., https://example.com)
 	return "https://" + parsedURL.Host + "/"
 }
+
+// parsedHost returns the host of URL, which is what history records are keyed by.
+func parsedHost(URL string) string {
+	parsedURL, err := url.Parse(URL)
+	if err != nil {
+		return URL
+	}
+	return parsedURL.Hostname()
+}
@@ -0,0 +1,94 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrHomeNotSet is returned when the config directory has to be derived from
+// $HOME but the variable is empty.
+var ErrHomeNotSet = errors.New("HOME environment variable not set")
+
+// ConfigError describes a failure to locate, read or write a config file.
+type ConfigError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *ConfigError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("config %s: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("config %s %s: %v", e.Op, e.Path, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// ConfigLocation resolves the names of the config files (DNS_CONFIG_FILE,
+// DOCKER_CONFIG_FILE, ...) to absolute paths on disk.
+type ConfigLocation interface {
+	Resolve(name string) (string, error)
+}
+
+// HomeLocation resolves config files relative to $HOME, which is where the
+// CLI has always kept them.
+type HomeLocation struct{}
+
+func (HomeLocation) Resolve(name string) (string, error) {
+	homeDir := os.Getenv("HOME")
+	if homeDir == "" {
+		return "", &ConfigError{Op: "resolve", Path: name, Err: ErrHomeNotSet}
+	}
+	return filepath.Join(homeDir, name), nil
+}
+
+// DirLocation resolves config files inside the given directory instead of
+// CONFIG_DIR, so DirLocation("/etc/403unlocker") maps DNS_CONFIG_FILE to
+// /etc/403unlocker/dns.conf.
+type DirLocation string
+
+func (d DirLocation) Resolve(name string) (string, error) {
+	if d == "" {
+		return "", &ConfigError{Op: "resolve", Path: name, Err: errors.New("empty config directory")}
+	}
+	return filepath.Join(string(d), filepath.FromSlash(relativeToConfigDir(name))), nil
+}
+
+// ProfileLocation resolves config files of a named profile below Base. The
+// default profile lives directly in the config directory so existing setups
+// keep working; other profiles live in PROFILES_DIR/<name>.
+type ProfileLocation struct {
+	Base ConfigLocation
+	Name string
+}
+
+func (p ProfileLocation) Resolve(name string) (string, error) {
+	if p.Name == "" || p.Name == DEFAULT_PROFILE {
+		return p.Base.Resolve(name)
+	}
+	return p.Base.Resolve(path.Join(PROFILES_DIR, p.Name, relativeToConfigDir(name)))
+}
+
+// relativeToConfigDir strips the CONFIG_DIR prefix from name.
+func relativeToConfigDir(name string) string {
+	if rel, ok := strings.CutPrefix(name, CONFIG_DIR+"/"); ok {
+		return rel
+	}
+	return path.Base(name)
+}
+
+// Config is the location used by the package level helpers. Commands and
+// library users can replace it to read and write config files elsewhere.
+var Config ConfigLocation = HomeLocation{}
+
+// ConfigPath resolves name using Config.
+func ConfigPath(name string) (string, error) {
+	return Config.Resolve(name)
+}
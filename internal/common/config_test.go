@@ -0,0 +1,58 @@
+package common
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHomeLocationWithoutHome(t *testing.T) {
+	t.Setenv("HOME", "")
+
+	_, err := HomeLocation{}.Resolve(DNS_CONFIG_FILE)
+
+	var cfgErr *ConfigError
+	assert.True(t, errors.As(err, &cfgErr))
+	assert.True(t, errors.Is(err, ErrHomeNotSet))
+}
+
+func TestDirLocation(t *testing.T) {
+	tests := []struct {
+		name     string
+		dir      DirLocation
+		file     string
+		expected string
+		wantErr  bool
+	}{
+		{"DNS config", "/etc/403unlocker", DNS_CONFIG_FILE, "/etc/403unlocker/dns.conf", false},
+		{"Docker config", "/etc/403unlocker", DOCKER_CONFIG_FILE, "/etc/403unlocker/dockerRegistry.conf", false},
+		{"Empty directory", "", DNS_CONFIG_FILE, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := tt.dir.Resolve(tt.file)
+			assert.Equal(t, tt.wantErr, err != nil, "Test case: %s", tt.name)
+			assert.Equal(t, tt.expected, result, "Test case: %s", tt.name)
+		})
+	}
+}
+
+func TestWriteAndReadDNSFile(t *testing.T) {
+	dir := t.TempDir()
+	previous := Config
+	Config = DirLocation(filepath.Join(dir, "nested"))
+	t.Cleanup(func() { Config = previous })
+
+	assert.NoError(t, WriteDNSToFile(CHECKED_DNS_CONFIG_FILE, []string{"1.1.1.1", "8.8.8.8"}))
+
+	dnsList, err := ReadDNSFromFile(CHECKED_DNS_CONFIG_FILE)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1.1.1.1", "8.8.8.8"}, dnsList)
+
+	_, err = ReadDNSFromFile(DNS_CONFIG_FILE)
+	var cfgErr *ConfigError
+	assert.True(t, errors.As(err, &cfgErr))
+}
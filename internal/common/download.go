@@ -0,0 +1,72 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DownloadOptions control what benchmarks do with the data they download.
+type DownloadOptions struct {
+	// KeepDir, if set, receives the data downloaded from every server in
+	// KeepDir/<server>/. Otherwise the data is only counted and discarded.
+	KeepDir string
+	// MaxBytes stops each download after this many bytes. Zero means no limit.
+	MaxBytes int64
+}
+
+// KeepFile creates the file name for data downloaded from server under KeepDir.
+func (o DownloadOptions) KeepFile(server, name string) (*os.File, error) {
+	dir := filepath.Join(o.KeepDir, sanitizeFileName(server))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return os.Create(filepath.Join(dir, sanitizeFileName(name)))
+}
+
+func sanitizeFileName(name string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(name)
+	if name == "" || name == "." || name == ".." {
+		return "download"
+	}
+	return name
+}
+
+// ParseDataSize parses a size such as 500, 512KB, 100MB or 1.5GB, using the
+// same 1024 based units as FormatDataSize. An empty size is zero.
+func ParseDataSize(size string) (int64, error) {
+	value := strings.TrimSpace(strings.ToUpper(size))
+	if value == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(value, unit.suffix) {
+			value, multiplier = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix)), unit.size
+			break
+		}
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected a number of bytes or KB, MB or GB", size)
+	}
+	return int64(number * float64(multiplier)), nil
+}
+
+// Extrapolate returns how many bytes would have been received in timeout at
+// the rate of bytes in elapsed. Benchmarks report the data received in the
+// full timeout, so downloads that finish early, because the file is small or
+// --max-bytes was reached, are not ranked below slower servers. Only clean
+// downloads may be extrapolated; one cut short by an error is reported as is.
+func Extrapolate(bytes int64, elapsed, timeout time.Duration) int64 {
+	if elapsed <= 0 || elapsed >= timeout {
+		return bytes
+	}
+	return int64(float64(bytes) * float64(timeout) / float64(elapsed))
+}
@@ -0,0 +1,41 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDataSize(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected int64
+		wantErr  bool
+	}{
+		{"", 0, false},
+		{"500", 500, false},
+		{"512KB", 512 << 10, false},
+		{"100mb", 100 << 20, false},
+		{"1.5GB", 3 << 29, false},
+		{"10 B", 10, false},
+		{"MB", 0, true},
+		{"-1KB", 0, true},
+		{"ten", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			result, err := ParseDataSize(tt.value)
+			assert.Equal(t, tt.wantErr, err != nil, "Test case: %s", tt.value)
+			assert.Equal(t, tt.expected, result, "Test case: %s", tt.value)
+		})
+	}
+}
+
+func TestExtrapolate(t *testing.T) {
+	assert.Equal(t, int64(5000), Extrapolate(1000, 2*time.Second, 10*time.Second))
+	assert.Equal(t, int64(1000), Extrapolate(1000, 10*time.Second, 10*time.Second))
+	assert.Equal(t, int64(1000), Extrapolate(1000, 12*time.Second, 10*time.Second))
+	assert.Equal(t, int64(0), Extrapolate(0, time.Second, 10*time.Second))
+}
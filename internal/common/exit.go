@@ -0,0 +1,54 @@
+package common
+
+import (
+	"context"
+	"errors"
+)
+
+// Exit codes of the 403unlocker command, documented in the README.
+const (
+	EXIT_OK            = 0
+	EXIT_ERROR         = 1
+	EXIT_NONE_WORKED   = 2
+	EXIT_CONFIG_ERROR  = 3
+	EXIT_INVALID_INPUT = 4
+	// EXIT_INTERRUPTED follows the shell convention of 128 + SIGINT.
+	EXIT_INTERRUPTED = 130
+)
+
+var (
+	// ErrNoneWorked is returned when no DNS server or registry worked and the
+	// user asked to fail in that case (--fail-if-none).
+	ErrNoneWorked = errors.New("nothing worked")
+	// ErrInvalidInput is returned for invalid arguments and flags.
+	ErrInvalidInput = errors.New("invalid input")
+	// ErrInterrupted is returned when the user interrupted a command that
+	// still printed its partial results.
+	ErrInterrupted = errors.New("interrupted, results are partial")
+)
+
+// Interrupted returns ErrInterrupted when ctx was cancelled and nil otherwise.
+func Interrupted(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return ErrInterrupted
+	}
+	return nil
+}
+
+// ExitCode returns the exit code for the error a command returned.
+func ExitCode(err error) int {
+	var cfgErr *ConfigError
+	switch {
+	case err == nil:
+		return EXIT_OK
+	case errors.Is(err, ErrInterrupted), errors.Is(err, context.Canceled):
+		return EXIT_INTERRUPTED
+	case errors.Is(err, ErrInvalidInput):
+		return EXIT_INVALID_INPUT
+	case errors.Is(err, ErrNoneWorked):
+		return EXIT_NONE_WORKED
+	case errors.As(err, &cfgErr):
+		return EXIT_CONFIG_ERROR
+	}
+	return EXIT_ERROR
+}
@@ -0,0 +1,31 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{"Success", nil, EXIT_OK},
+		{"Nothing worked", fmt.Errorf("%w: no DNS server could reach pkg.go.dev", ErrNoneWorked), EXIT_NONE_WORKED},
+		{"Config error", fmt.Errorf("error reading DNS list: %w", &ConfigError{Op: "read", Path: "dns.conf", Err: errors.New("denied")}), EXIT_CONFIG_ERROR},
+		{"HOME not set", &ConfigError{Op: "resolve", Path: DNS_CONFIG_FILE, Err: ErrHomeNotSet}, EXIT_CONFIG_ERROR},
+		{"Invalid input", fmt.Errorf("%w: invalid URL", ErrInvalidInput), EXIT_INVALID_INPUT},
+		{"Interrupted", ErrInterrupted, EXIT_INTERRUPTED},
+		{"Other error", errors.New("boom"), EXIT_ERROR},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, ExitCode(tt.err), "Test case: %s", tt.name)
+		})
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 const (
@@ -24,11 +25,19 @@ const (
 	White   = "\033[97m"
 
 	// DNS config
-	DNS_CONFIG_FILE         = ".config/403unlocker/dns.conf"
-	CHECKED_DNS_CONFIG_FILE = ".config/403unlocker/checked_dns.conf"
-	DOCKER_CONFIG_FILE      = ".config/403unlocker/dockerRegistry.conf"
+	CONFIG_DIR              = ".config/403unlocker"
+	DNS_CONFIG_FILE         = CONFIG_DIR + "/dns.conf"
+	CHECKED_DNS_CONFIG_FILE = CONFIG_DIR + "/checked_dns.conf"
+	DOCKER_CONFIG_FILE      = CONFIG_DIR + "/dockerRegistry.conf"
 	DNS_CONFIG_URL          = "https://raw.githubusercontent.com/403unlocker/403Unlocker-cli/refs/heads/main/config/dns.conf"
 	DOCKER_CONFIG_URL       = "https://raw.githubusercontent.com/403unlocker/403Unlocker-cli/refs/heads/main/config/dockerRegistry.conf"
+
+	// Profiles
+	PROFILES_DIR          = CONFIG_DIR + "/profiles"
+	ACTIVE_PROFILE_FILE   = CONFIG_DIR + "/profile"
+	PROFILE_DEFAULTS_FILE = CONFIG_DIR + "/defaults.conf"
+	NETWORK_PROFILES_FILE = CONFIG_DIR + "/network-profiles.conf"
+	DEFAULT_PROFILE       = "default"
 )
 
 // FormatDataSize converts the size in bytes to a human-readable string in KB, MB, or GB.
@@ -51,116 +60,146 @@ func FormatDataSize(bytes int64) string {
 	}
 }
 
+// DownloadConfigFile fetches url and stores it as the config file path.
 func DownloadConfigFile(url, path string) error {
-
-	homeDir := os.Getenv("HOME")
-	if homeDir == "" {
-		fmt.Println("HOME environment variable not set")
-		os.Exit(1)
+	filePath, err := ConfigPath(path)
+	if err != nil {
+		return err
 	}
-	filePath := homeDir + "/" + path
+	return DownloadFile(url, filePath)
+}
 
+// DownloadFile fetches url and stores it at the absolute path filePath.
+func DownloadFile(url, filePath string) error {
 	dir := filepath.Dir(filePath)
 	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
-		fmt.Printf("Error creating directory: %v\n", err)
-		return err
+		return &ConfigError{Op: "create directory", Path: dir, Err: err}
 	}
 
-	out, err := os.Create(filePath)
-
+	resp, err := http.Get(url)
 	if err != nil {
-		fmt.Println(err)
-
-		return err
+		return &ConfigError{Op: "download", Path: url, Err: err}
 	}
-	defer out.Close()
+	defer resp.Body.Close()
 
-	if err != nil {
-		fmt.Println("Could not download config file.")
-		return err
+	if resp.StatusCode != http.StatusOK {
+		return &ConfigError{Op: "download", Path: url, Err: fmt.Errorf("unexpected status %s", resp.Status)}
 	}
 
-	resp, err := http.Get(url)
-
+	out, err := os.Create(filePath)
 	if err != nil {
-		fmt.Println("Could not get the response: ", err)
-		return err
+		return &ConfigError{Op: "create", Path: filePath, Err: err}
 	}
-
-	defer resp.Body.Close()
+	defer out.Close()
 
 	_, err = io.Copy(out, resp.Body)
-
 	if err != nil {
-		fmt.Println("Could not copy content file")
-		return err
+		return &ConfigError{Op: "write", Path: filePath, Err: err}
 	}
 
 	return nil
 }
 
-func WriteDNSToFile(filename string, dnsList []string) error {
-	homeDir := os.Getenv("HOME")
-	if homeDir == "" {
-		fmt.Println("HOME environment variable not set")
-		os.Exit(1)
+// ReadOrDownloadConfig reads the list in the config file name, downloading it
+// from url first when it cannot be read.
+func ReadOrDownloadConfig(name, url string) ([]string, error) {
+	list, err := ReadDNSFromFile(name)
+	if err == nil {
+		return list, nil
+	}
+	if err := DownloadConfigFile(url, name); err != nil {
+		return nil, err
 	}
+	return ReadDNSFromFile(name)
+}
 
-	filename = homeDir + "/" + filename
+// WriteDNSToFile stores dnsList as a space separated list in the config file filename.
+func WriteDNSToFile(filename string, dnsList []string) error {
+	filename, err := ConfigPath(filename)
+	if err != nil {
+		return err
+	}
 
-	_, err := os.Stat(filename)
-	if os.IsNotExist(err) {
-		file, err := os.Create(filename)
-		if err != nil {
-			fmt.Printf("Error creating file %s: %v\n", filename, err)
-			return err
-		}
-		file.Close()
+	if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+		return &ConfigError{Op: "create directory", Path: filepath.Dir(filename), Err: err}
 	}
 
 	content := strings.Join(dnsList, " ")
 
 	err = os.WriteFile(filename, []byte(content), 0644)
 	if err != nil {
-		fmt.Printf("Error writing to file %s: %v\n", filename, err)
-		return err
+		return &ConfigError{Op: "write", Path: filename, Err: err}
 	}
 
 	return nil
 }
 
+// ReadDNSFromFile reads a whitespace separated list from the config file filename.
 func ReadDNSFromFile(filename string) ([]string, error) {
-	homeDir := os.Getenv("HOME")
-	if homeDir == "" {
-		fmt.Println("HOME environment variable not set")
-		os.Exit(1)
+	filename, err := ConfigPath(filename)
+	if err != nil {
+		return nil, err
 	}
-	filename = homeDir + "/" + filename
 	data, err := os.ReadFile(filename)
 	if err != nil {
-		return nil, err
+		return nil, &ConfigError{Op: "read", Path: filename, Err: err}
 	}
 	dnsServers := strings.Fields(string(data))
 	return dnsServers, nil
 }
 
+// Timeouts limit the requests of a client returned by NewDNSClient. Zero
+// means no limit.
+type Timeouts struct {
+	// Request limits the whole request, from dialing until the response
+	// headers and body are read.
+	Request time.Duration
+	// Dial limits connecting to the server, including the DNS lookup.
+	Dial time.Duration
+	// DNS limits each query to the DNS server.
+	DNS time.Duration
+}
+
+// DefaultTimeouts are used for probes when the user did not choose any.
+var DefaultTimeouts = Timeouts{
+	Request: 10 * time.Second,
+	Dial:    5 * time.Second,
+	DNS:     3 * time.Second,
+}
+
+// ChangeDNS returns a client resolving every host through dns. It has no
+// request timeout, so it can be used for downloads limited by a context.
 func ChangeDNS(dns string) *http.Client {
+	return NewDNSClient(dns, Timeouts{Dial: DefaultTimeouts.Dial, DNS: DefaultTimeouts.DNS})
+}
+
+// NewDNSClient returns a client resolving every host through dns, limited by timeouts.
+func NewDNSClient(dns string, timeouts Timeouts) *http.Client {
 	dialer := &net.Dialer{}
 	customResolver := &net.Resolver{
 		PreferGo: true,
 		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
 			dnsServer := fmt.Sprintf("%s:53", dns)
-			return dialer.DialContext(ctx, "udp", dnsServer)
+			conn, err := dialer.DialContext(ctx, "udp", dnsServer)
+			if err != nil {
+				return nil, err
+			}
+			if timeouts.DNS > 0 {
+				conn.SetDeadline(time.Now().Add(timeouts.DNS))
+			}
+			return conn, nil
 		},
 	}
 	customDialer := &net.Dialer{
 		Resolver: customResolver,
+		Timeout:  timeouts.Dial,
 	}
 	transport := &http.Transport{
 		DialContext: customDialer.DialContext,
 	}
 	client := &http.Client{
 		Transport: transport,
+		Timeout:   timeouts.Request,
 	}
 	return client
 }
@@ -0,0 +1,146 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// ColorEnabled reports whether Colorize emits ANSI escape codes.
+var ColorEnabled = true
+
+// SetupColor enables colors only when stdout is a terminal, NO_COLOR
+// (https://no-color.org) is not set and noColor is false.
+func SetupColor(noColor bool) {
+	ColorEnabled = !noColor && os.Getenv("NO_COLOR") == "" && IsTerminal(os.Stdout)
+}
+
+// IsTerminal reports whether f is an interactive terminal.
+func IsTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// Progress shows "label done/total" on a single stderr line when stderr is
+// a terminal. Call it with done == total to clear the line.
+func Progress(label string, done, total int) {
+	if !IsTerminal(os.Stderr) {
+		return
+	}
+	if done >= total {
+		ClearProgress()
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\r\033[K%s %d/%d", label, done, total)
+}
+
+// ClearProgress removes the line written by Progress, for runs that stop early.
+func ClearProgress() {
+	if IsTerminal(os.Stderr) {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+	}
+}
+
+// Colorize wraps text in color when colors are enabled.
+func Colorize(color, text string) string {
+	if !ColorEnabled || color == "" {
+		return text
+	}
+	return color + text + Reset
+}
+
+// Cell is one value of a table row, optionally colored.
+type Cell struct {
+	Text  string
+	Color string
+}
+
+// Plain returns an uncolored cell.
+func Plain(text string) Cell {
+	return Cell{Text: text}
+}
+
+// Colored returns a cell printed in color.
+func Colored(color, text string) Cell {
+	return Cell{Text: text, Color: color}
+}
+
+// Table prints rows in bordered columns sized to their widest value.
+type Table struct {
+	headers []string
+	rows    [][]Cell
+}
+
+// NewTable returns an empty table with the given column headers.
+func NewTable(headers ...string) *Table {
+	return &Table{headers: headers}
+}
+
+// AddRow appends a row. Missing cells are left empty.
+func (t *Table) AddRow(cells ...Cell) {
+	t.rows = append(t.rows, cells)
+}
+
+// Len returns the number of rows.
+func (t *Table) Len() int {
+	return len(t.rows)
+}
+
+// Render writes the table to w in the order the rows were added.
+func (t *Table) Render(w io.Writer) error {
+	widths := make([]int, len(t.headers))
+	for i, header := range t.headers {
+		widths[i] = utf8.RuneCountInString(header)
+	}
+	for _, row := range t.rows {
+		for i, cell := range row {
+			if i < len(widths) {
+				widths[i] = max(widths[i], utf8.RuneCountInString(cell.Text))
+			}
+		}
+	}
+
+	var border strings.Builder
+	border.WriteString("+")
+	for _, width := range widths {
+		border.WriteString(strings.Repeat("-", width+2) + "+")
+	}
+	border.WriteString("\n")
+
+	var b strings.Builder
+	b.WriteString(border.String())
+	headers := make([]Cell, len(t.headers))
+	for i, header := range t.headers {
+		headers[i] = Plain(header)
+	}
+	writeRow(&b, widths, headers)
+	b.WriteString(border.String())
+	for _, row := range t.rows {
+		writeRow(&b, widths, row)
+	}
+	b.WriteString(border.String())
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Print writes the table to stdout.
+func (t *Table) Print() {
+	t.Render(os.Stdout)
+}
+
+func writeRow(b *strings.Builder, widths []int, cells []Cell) {
+	b.WriteString("|")
+	for i, width := range widths {
+		var cell Cell
+		if i < len(cells) {
+			cell = cells[i]
+		}
+		padded := cell.Text + strings.Repeat(" ", width-utf8.RuneCountInString(cell.Text))
+		fmt.Fprintf(b, " %s |", Colorize(cell.Color, padded))
+	}
+	b.WriteString("\n")
+}
@@ -0,0 +1,53 @@
+package common
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableRender(t *testing.T) {
+	ColorEnabled = false
+	defer func() { ColorEnabled = true }()
+
+	table := NewTable("DNS Server", "Status")
+	table.AddRow(Plain("2001:4860:4860::8888"), Colored(Green, "OK"))
+	table.AddRow(Plain("1.1.1.1"), Colored(Red, "Forbidden"))
+
+	var b strings.Builder
+	assert.NoError(t, table.Render(&b))
+
+	expected := `+----------------------+-----------+
+| DNS Server           | Status    |
++----------------------+-----------+
+| 2001:4860:4860::8888 | OK        |
+| 1.1.1.1              | Forbidden |
++----------------------+-----------+
+`
+	assert.Equal(t, expected, b.String())
+}
+
+func TestTableRenderColors(t *testing.T) {
+	ColorEnabled = true
+
+	table := NewTable("Server", "Status")
+	table.AddRow(Plain("1.1.1.1"), Colored(Red, "Forbidden"))
+
+	var b strings.Builder
+	assert.NoError(t, table.Render(&b))
+	assert.Contains(t, b.String(), "| 1.1.1.1 | "+Red+"Forbidden"+Reset+" |")
+}
+
+func TestSetupColor(t *testing.T) {
+	t.Setenv("NO_COLOR", "1")
+	SetupColor(false)
+	assert.False(t, ColorEnabled)
+	assert.Equal(t, "OK", Colorize(Green, "OK"))
+
+	t.Setenv("NO_COLOR", "")
+	SetupColor(true)
+	assert.False(t, ColorEnabled)
+
+	ColorEnabled = true
+}
@@ -0,0 +1,119 @@
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+)
+
+// DEFAULT_CACHE_TTL is how long a checked DNS cache is trusted by default.
+const DEFAULT_CACHE_TTL = 24 * time.Hour
+
+// CacheEntry is the result of checking one DNS server.
+type CacheEntry struct {
+	Server     string `json:"server"`
+	OK         bool   `json:"ok"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Cache is the content of the checked DNS cache: which servers could reach
+// Domain, checked at CheckedAt on the network Network.
+type Cache struct {
+	Domain    string       `json:"domain"`
+	CheckedAt time.Time    `json:"checked_at"`
+	Network   string       `json:"network"`
+	Results   []CacheEntry `json:"results"`
+}
+
+// Expired reports whether the cache is older than ttl at now. The TTL is not
+// stored with the cache, so whatever --cache-ttl is asked for applies to
+// existing caches too.
+func (c *Cache) Expired(now time.Time, ttl time.Duration) bool {
+	return c.CheckedAt.IsZero() || now.After(c.CheckedAt.Add(ttl))
+}
+
+// ValidServers returns the servers that reached the domain.
+func (c *Cache) ValidServers() []string {
+	var servers []string
+	for _, result := range c.Results {
+		if result.OK {
+			servers = append(servers, result.Server)
+		}
+	}
+	return servers
+}
+
+// StaleReason explains why the cache cannot be reused for domain on the
+// network with the given ID with ttl, or returns "" when it can.
+func (c *Cache) StaleReason(domain, network string, now time.Time, ttl time.Duration) string {
+	switch {
+	case c.CheckedAt.IsZero():
+		return "cache has no metadata"
+	case !strings.EqualFold(c.Domain, domain):
+		return fmt.Sprintf("cache was built for %s, not %s", c.Domain, domain)
+	case c.Network != network:
+		return fmt.Sprintf("cache was built on network %s", c.Network)
+	case c.Expired(now, ttl):
+		return fmt.Sprintf("cache expired at %s", c.CheckedAt.Add(ttl).Format(time.RFC3339))
+	}
+	return ""
+}
+
+// CacheDomain returns the domain a URL is cached under.
+func CacheDomain(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return strings.ToLower(rawURL)
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// LoadCache reads the cache config file name. Caches written by older versions,
+// which hold only a space separated server list, are returned without
+// metadata so they are always considered stale.
+func LoadCache(name string) (*Cache, error) {
+	file, err := common.ConfigPath(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, &common.ConfigError{Op: "read", Path: file, Err: err}
+	}
+
+	var cache Cache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		cache = Cache{}
+		for _, server := range strings.Fields(string(data)) {
+			cache.Results = append(cache.Results, CacheEntry{Server: server, OK: true})
+		}
+	}
+	return &cache, nil
+}
+
+// SaveCache writes cache to the config file name.
+func SaveCache(name string, cache *Cache) error {
+	file, err := common.ConfigPath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return &common.ConfigError{Op: "create directory", Path: filepath.Dir(file), Err: err}
+	}
+	data, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(file, append(data, '\n'), 0644); err != nil {
+		return &common.ConfigError{Op: "write", Path: file, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package dns
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+	"gotest.tools/v3/assert"
+)
+
+func TestCacheStaleReason(t *testing.T) {
+	checkedAt := time.Date(2025, 1, 15, 8, 0, 0, 0, time.UTC)
+	cache := &Cache{
+		Domain:    "registry.npmjs.org",
+		CheckedAt: checkedAt,
+		Network:   "7d7ae6a2561b",
+	}
+
+	tests := []struct {
+		name     string
+		cache    *Cache
+		domain   string
+		network  string
+		now      time.Time
+		ttl      time.Duration
+		expected bool
+	}{
+		{"Fresh cache", cache, "registry.npmjs.org", "7d7ae6a2561b", checkedAt.Add(time.Minute), time.Hour, false},
+		{"Domain is case insensitive", cache, "Registry.NPMJS.org", "7d7ae6a2561b", checkedAt.Add(time.Minute), time.Hour, false},
+		{"Other domain", cache, "pkg.go.dev", "7d7ae6a2561b", checkedAt.Add(time.Minute), time.Hour, true},
+		{"Other network", cache, "registry.npmjs.org", "000000000000", checkedAt.Add(time.Minute), time.Hour, true},
+		{"Expired", cache, "registry.npmjs.org", "7d7ae6a2561b", checkedAt.Add(2 * time.Hour), time.Hour, true},
+		{"Shorter TTL than before", cache, "registry.npmjs.org", "7d7ae6a2561b", checkedAt.Add(45 * time.Minute), 30 * time.Minute, true},
+		{"Longer TTL than before", cache, "registry.npmjs.org", "7d7ae6a2561b", checkedAt.Add(2 * time.Hour), 3 * time.Hour, false},
+		{"Legacy cache", &Cache{}, "registry.npmjs.org", "7d7ae6a2561b", checkedAt, time.Hour, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason := tt.cache.StaleReason(tt.domain, tt.network, tt.now, tt.ttl)
+			assert.Equal(t, tt.expected, reason != "", "Test case: %s (%s)", tt.name, reason)
+		})
+	}
+}
+
+func TestCacheDomain(t *testing.T) {
+	assert.Equal(t, "packages.gitlab.com", CacheDomain("https://packages.gitlab.com/gitlab/gitlab-ce/download.rpm"))
+	assert.Equal(t, "localhost", CacheDomain("http://LOCALHOST:8080"))
+}
+
+func TestLoadCache(t *testing.T) {
+	dir := t.TempDir()
+	previous := common.Config
+	common.Config = common.DirLocation(dir)
+	t.Cleanup(func() { common.Config = previous })
+
+	cache := &Cache{
+		Domain:    "pkg.go.dev",
+		CheckedAt: time.Now().UTC().Truncate(time.Second),
+		Network:   "unknown",
+		Results: []CacheEntry{
+			{Server: "1.1.1.1", OK: false, StatusCode: 403, Status: "Forbidden"},
+			{Server: "10.202.10.202", OK: true, StatusCode: 200, Status: "OK"},
+		},
+	}
+	assert.NilError(t, SaveCache(common.CHECKED_DNS_CONFIG_FILE, cache))
+
+	loaded, err := LoadCache(common.CHECKED_DNS_CONFIG_FILE)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, cache, loaded)
+	assert.DeepEqual(t, []string{"10.202.10.202"}, loaded.ValidServers())
+
+	// Caches written before metadata existed are plain server lists.
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "checked_dns.conf"), []byte("8.8.8.8 9.9.9.9"), 0644))
+	loaded, err = LoadCache(common.CHECKED_DNS_CONFIG_FILE)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"8.8.8.8", "9.9.9.9"}, loaded.ValidServers())
+	assert.Assert(t, loaded.Expired(time.Now(), DEFAULT_CACHE_TTL))
+}
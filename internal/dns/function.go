@@ -2,17 +2,21 @@ package dns
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
-	"strconv"
-	"strings"
-	"sync"
+	"path"
+	"sort"
+	"sync/atomic"
 	"time"
 
-	"github.com/cavaliergopher/grab/v3"
+	"github.com/salehborhani/403Unlocker-cli/internal/check"
 	"github.com/salehborhani/403Unlocker-cli/internal/common"
+	"github.com/salehborhani/403Unlocker-cli/internal/history"
+	"github.com/salehborhani/403Unlocker-cli/internal/network"
 	"github.com/urfave/cli/v2"
 )
 
@@ -33,186 +37,366 @@ func URLValidator(URL string) bool {
 	return true
 }
 
-func CheckAndCacheDNS(url string) error {
-	cacheFile := common.CHECKED_DNS_CONFIG_FILE
+// CheckAndCacheDNS checks every configured DNS server against url and caches
+// the results, with the domain and time, for the current network. ttl is only
+// reported, every read decides with its own. The report is written to out;
+// progress is only shown when out is os.Stdout.
+func CheckAndCacheDNS(ctx context.Context, url string, ttl time.Duration, timeouts common.Timeouts, out io.Writer) error {
+	fingerprint := network.Current(ctx)
+	cacheFile := network.CacheFile(common.CHECKED_DNS_CONFIG_FILE, fingerprint.ID())
 
-	dnsList, err := common.ReadDNSFromFile(common.DNS_CONFIG_FILE)
+	dnsList, err := common.ReadOrDownloadConfig(common.DNS_CONFIG_FILE, common.DNS_CONFIG_URL)
 	if err != nil {
-		err = common.DownloadConfigFile(common.DNS_CONFIG_URL, common.DNS_CONFIG_FILE)
-		if err != nil {
-			fmt.Println("Error downloading DNS config file:", err)
-			return err
-		}
-
-		dnsList, err = common.ReadDNSFromFile(common.DNS_CONFIG_FILE)
-		if err != nil {
-			fmt.Println("Error reading DNS list from file:", err)
-			return err
-		}
+		fmt.Fprintln(out, "Error reading DNS list:", err)
+		return err
 	}
 
-	fmt.Println("\n+--------------------+------------+")
-	fmt.Printf("| %-18s | %-10s |\n", "DNS Server", "Status")
-	fmt.Println("+--------------------+------------+")
-
-	var validDNSList []string
-	var wg sync.WaitGroup
-	var mu sync.Mutex
+	fmt.Fprintf(out, "Checking %d DNS servers...\n\n", len(dnsList))
 
-	for _, dns := range dnsList {
-		wg.Add(1)
-		go func(dns string) {
-			defer wg.Done()
-
-			// Change DNS for the HTTP client
-			client := common.ChangeDNS(dns)
-
-			// Perform the GET request
-			resp, err := client.Get(url)
-			if err != nil {
-				fmt.Printf("| %-18s | %s%-10s%s |\n", dns, common.Red, "Error", common.Reset)
-				return
-			}
-			defer resp.Body.Close()
-
-			// Parse the status code
-			codeParts := strings.Split(resp.Status, " ")
-			if len(codeParts) < 2 {
-				fmt.Printf("| %-18s | %s%-10s%s |\n", dns, common.Red, "Invalid", common.Reset)
-				return
-			}
+	cache := &Cache{
+		Domain:    CacheDomain(url),
+		CheckedAt: time.Now(),
+		Network:   fingerprint.ID(),
+	}
+	done := 0
+	results := check.Probe(ctx, url, dnsList, timeouts, func(check.Result) {
+		done++
+		if out == os.Stdout {
+			common.Progress("Checked", done, len(dnsList))
+		}
+	})
+	if err := common.Interrupted(ctx); err != nil {
+		// A partial check must not replace the cache.
+		return err
+	}
+	check.SortResults(results)
+	for _, result := range results {
+		entry := CacheEntry{
+			Server:     result.Server,
+			OK:         result.OK(),
+			StatusCode: result.StatusCode,
+			Status:     result.Status,
+		}
+		if result.Err != nil {
+			entry.Error = result.Err.Error()
+		}
+		cache.Results = append(cache.Results, entry)
+	}
+	check.Table(results).Render(out)
+	fmt.Fprintln(out, check.Summary(results))
 
-			statusCode, err := strconv.Atoi(codeParts[0])
-			if err != nil {
-				fmt.Printf("| %-18s | %s%-10s%s |\n", dns, common.Red, "Error", common.Reset)
-				return
-			}
+	validDNSList := cache.ValidServers()
+	fmt.Fprintln(out, "Valid DNS List: ", validDNSList)
 
-			// Output the status with appropriate color
-			statusText := codeParts[1]
+	check.RecordHistory(ctx, history.KIND_CHECK, url, cache.CheckedAt, results)
 
-			if statusCode == http.StatusOK {
-				mu.Lock()
-				validDNSList = append(validDNSList, dns)
-				mu.Unlock()
-				fmt.Printf("| %-18s | %s%-10s%s |\n", dns, common.Green, statusText, common.Reset)
-			} else {
-				fmt.Printf("| %-18s | %s%-10s%s |\n", dns, common.Red, statusText, common.Reset)
-			}
-		}(dns)
+	err = SaveCache(cacheFile, cache)
+	if err != nil {
+		fmt.Fprintln(out, "Error writing to cached DNS file:", err)
+		return err
+	}
+	if err := network.Remember(fingerprint); err != nil {
+		fmt.Fprintln(out, "Error recording network fingerprint:", err)
+	}
+	if len(validDNSList) > 0 {
+		fmt.Fprintf(out, "Cached %d valid DNS servers for %s on network %s (%s), valid for %s\n",
+			len(validDNSList), cache.Domain, fingerprint.ID(), fingerprint, ttl)
+	} else {
+		fmt.Fprintln(out, "No valid DNS servers found to cache.")
 	}
 
-	wg.Wait()
+	return nil
+}
 
-	fmt.Println("+--------------------+------------+")
+// ValidCachedDNS returns the servers known to reach url on the current
+// network, re-checking them first when the cache is missing, expired, built
+// for another domain or network, or refresh is set. What it does is reported
+// to out, like in CheckAndCacheDNS.
+func ValidCachedDNS(ctx context.Context, url string, ttl time.Duration, refresh bool, timeouts common.Timeouts, out io.Writer) ([]string, error) {
+	fingerprint := network.Current(ctx)
+	domain := CacheDomain(url)
+
+	reason := "refresh requested"
+	if !refresh {
+		cache, err := loadNetworkCache(fingerprint.ID())
+		if err != nil {
+			reason = "no cache for this network"
+		} else if reason = cache.StaleReason(domain, fingerprint.ID(), time.Now(), ttl); reason == "" {
+			fmt.Fprintf(out, "Using DNS cache for %s checked at %s (expires in %s)\n",
+				domain, cache.CheckedAt.Format(time.RFC3339), time.Until(cache.CheckedAt.Add(ttl)).Round(time.Second))
+			return cache.ValidServers(), nil
+		}
+	}
 
-	fmt.Println("Valid DNS List: ", validDNSList)
+	fmt.Fprintf(out, "Refreshing DNS cache: %s\n", reason)
+	refreshErr := CheckAndCacheDNS(ctx, url, ttl, timeouts, out)
+	if errors.Is(refreshErr, common.ErrInterrupted) {
+		return nil, refreshErr
+	}
 
-	if len(validDNSList) > 0 {
-		err = common.WriteDNSToFile(cacheFile, validDNSList)
-		if err != nil {
-			fmt.Println("Error writing to cached DNS file:", err)
-			return err
+	// When the refresh failed, stale results (possibly from another network)
+	// are still better than none.
+	cacheFile, cachedOn, err := network.FindCache(common.CHECKED_DNS_CONFIG_FILE, fingerprint.ID())
+	if err != nil {
+		if refreshErr != nil {
+			return nil, refreshErr
 		}
-		fmt.Printf("Cached %d valid DNS servers to %s\n", len(validDNSList), cacheFile)
-	} else {
-		fmt.Println("No valid DNS servers found to cache.")
+		return nil, err
+	}
+	if refreshErr != nil {
+		fmt.Fprintln(out, common.Colorize(common.Yellow, fmt.Sprintf("Warning: could not refresh the DNS cache: %v; using stale results.", refreshErr)))
 	}
+	if cachedOn != fingerprint.ID() {
+		fmt.Fprintln(out, common.Colorize(common.Yellow, fmt.Sprintf("Warning: using DNS results cached on network %s; the current network is %s (%s). They may not apply here.",
+			network.Describe(cachedOn), fingerprint.ID(), fingerprint)))
+	}
+	cache, err := LoadCache(cacheFile)
+	if err != nil {
+		return nil, err
+	}
+	return cache.ValidServers(), nil
+}
 
-	return nil
+// loadNetworkCache reads the checked DNS cache of the network with the given ID.
+func loadNetworkCache(id string) (*Cache, error) {
+	return LoadCache(network.CacheFile(common.CHECKED_DNS_CONFIG_FILE, id))
 }
 
 func CheckWithURL(c *cli.Context) error {
 	fileToDownload := c.Args().First()
 
-	var dnsFile string
+	var dnsList []string
+	var err error
 	if c.Bool("check") {
-		err := CheckAndCacheDNS(fileToDownload)
+		dnsList, err = ValidCachedDNS(c.Context, fileToDownload, c.Duration("cache-ttl"), c.Bool("refresh"), check.TimeoutsFlag(c, "check-timeout"), os.Stdout)
 		if err != nil {
 			return err
 		}
-		dnsFile = common.CHECKED_DNS_CONFIG_FILE
-	} else {
-		dnsFile = common.DNS_CONFIG_FILE
-	}
-
-	// Read the DNS list from the determined file
-	dnsList, err := common.ReadDNSFromFile(dnsFile)
-	if err != nil {
-		// Fallback to download and read from the original DNS file
-		err = common.DownloadConfigFile(common.DNS_CONFIG_URL, common.DNS_CONFIG_FILE)
-		if err != nil {
-			return fmt.Errorf("error downloading DNS config file: %w", err)
+		// Every server failed the check, benchmarking them would only
+		// measure the failures again.
+		if len(dnsList) == 0 {
+			return fmt.Errorf("%w: no DNS server passed the check against %s, run without --check to benchmark all of them", common.ErrNoneWorked, CacheDomain(fileToDownload))
 		}
-		dnsList, err = common.ReadDNSFromFile(common.DNS_CONFIG_FILE)
+	} else {
+		dnsList, err = common.ReadOrDownloadConfig(common.DNS_CONFIG_FILE, common.DNS_CONFIG_URL)
 		if err != nil {
-			return fmt.Errorf("error reading DNS list from file: %w", err)
+			return fmt.Errorf("error reading DNS list: %w", err)
 		}
 	}
 
-	dnsSizeMap := make(map[string]int64)
-
 	timeout := c.Int("timeout")
 	fmt.Printf("\nTimeout: %d seconds\n", timeout)
 	fmt.Printf("URL: %s\n\n", fileToDownload)
 
-	// Print table header
-	fmt.Println("+--------------------+----------------+")
-	fmt.Printf("| %-18s | %-14s |\n", "DNS Server", "Download Speed")
-	fmt.Println("+--------------------+----------------+")
-
-	tempDir := time.Now().UnixMilli()
-	var wg sync.WaitGroup
-	for _, dns := range dnsList {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
-		defer cancel()
+	fmt.Printf("Benchmarking %d DNS servers...\n\n", len(dnsList))
 
-		clientWithCustomDNS := common.ChangeDNS(dns)
-		client := grab.NewClient()
-		client.HTTPClient = clientWithCustomDNS
+	maxBytes, err := common.ParseDataSize(c.String("max-bytes"))
+	if err != nil {
+		return fmt.Errorf("%w: --max-bytes: %v", common.ErrInvalidInput, err)
+	}
+	opts := common.DownloadOptions{KeepDir: c.String("keep"), MaxBytes: maxBytes}
+
+	started := time.Now()
+	done := 0
+	dnsSizeMap := Benchmark(c.Context, fileToDownload, dnsList, time.Duration(timeout)*time.Second, opts, func(dns string, size int64) {
+		done++
+		common.Progress("Benchmarked", done, len(dnsList))
+	})
+	interrupted := common.Interrupted(c.Context)
+	if interrupted != nil {
+		common.ClearProgress()
+		fmt.Printf("\nInterrupted after %d of %d DNS servers, the ranking below is partial.\n\n", len(dnsSizeMap), len(dnsList))
+	}
 
-		req, err := grab.NewRequest(fmt.Sprintf("/tmp/%v", tempDir), fileToDownload)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error creating request for DNS %s: %v\n", dns, err)
+	table := common.NewTable("DNS Server", "Download Speed")
+	for _, dns := range SortBySize(dnsSizeMap) {
+		size := dnsSizeMap[dns]
+		speed := common.FormatDataSize(size / int64(timeout))
+		if size == 0 {
+			table.AddRow(common.Plain(dns), common.Colored(common.Red, speed+"/s"))
+		} else {
+			table.AddRow(common.Plain(dns), common.Plain(speed+"/s"))
 		}
-		req = req.WithContext(ctx)
+	}
+	table.Print()
 
-		resp := client.Do(req)
-		dnsSizeMap[dns] = resp.BytesComplete()
+	RecordBenchmark(c.Context, fileToDownload, started, time.Duration(timeout)*time.Second, dnsSizeMap)
 
-		speed := common.FormatDataSize(resp.BytesComplete() / int64(timeout))
-		if resp.BytesComplete() == 0 {
-			fmt.Printf("| %-18s | %s%-14s%s |\n", dns, common.Red, speed+"/s", common.Reset)
-		} else {
-			fmt.Printf("| %-18s | %-14s |\n", dns, speed+"/s")
-		}
+	// Find and display the best DNS
+	maxDNS, maxSize := Best(dnsSizeMap)
 
+	fmt.Println() // Add a blank line for separation
+	if maxDNS != "" {
+		bestSpeed := common.FormatDataSize(maxSize / int64(timeout))
+		fmt.Printf("Best DNS: %s (%s)\n",
+			common.Colorize(common.Green, maxDNS), common.Colorize(common.Green, bestSpeed+"/s"))
+	} else {
+		fmt.Println("No DNS server was able to download any data.")
+	}
+	if interrupted != nil {
+		return interrupted
+	}
+	if maxDNS == "" && c.Bool("fail-if-none") {
+		return fmt.Errorf("%w: no DNS server could download %s", common.ErrNoneWorked, fileToDownload)
 	}
 
-	wg.Wait()
-	// Print table footer
-	fmt.Println("+--------------------+----------------+")
+	return nil
+}
 
-	// Find and display the best DNS
+// SortBySize returns the servers of dnsSizeMap, the ones that downloaded the
+// most data first and ties by address.
+func SortBySize(dnsSizeMap map[string]int64) []string {
+	servers := make([]string, 0, len(dnsSizeMap))
+	for dns := range dnsSizeMap {
+		servers = append(servers, dns)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		a, b := servers[i], servers[j]
+		if dnsSizeMap[a] != dnsSizeMap[b] {
+			return dnsSizeMap[a] > dnsSizeMap[b]
+		}
+		return a < b
+	})
+	return servers
+}
+
+// Best returns the server that downloaded the most data, if any did.
+func Best(dnsSizeMap map[string]int64) (string, int64) {
 	var maxDNS string
 	var maxSize int64
 	for dns, size := range dnsSizeMap {
-		if size > maxSize {
+		if size > maxSize || (size == maxSize && size > 0 && dns < maxDNS) {
 			maxDNS = dns
 			maxSize = size
 		}
 	}
+	return maxDNS, maxSize
+}
 
-	fmt.Println() // Add a blank line for separation
-	if maxDNS != "" {
-		bestSpeed := common.FormatDataSize(maxSize / int64(timeout))
-		fmt.Printf("Best DNS: %s%s%s (%s%s/s%s)\n",
-			common.Green, maxDNS, common.Reset,
-			common.Green, bestSpeed, common.Reset)
-	} else {
-		fmt.Println("No DNS server was able to download any data.")
+// RecordBenchmark stores the result of benchmarking url in the history database.
+func RecordBenchmark(ctx context.Context, url string, started time.Time, timeout time.Duration, dnsSizeMap map[string]int64) {
+	seconds := int64(timeout / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	measurements := make([]history.Measurement, 0, len(dnsSizeMap))
+	for dns, size := range dnsSizeMap {
+		measurements = append(measurements, history.Measurement{
+			Time:           started,
+			Kind:           history.KIND_BESTDNS,
+			Target:         CacheDomain(url),
+			Server:         dns,
+			Network:        network.Current(ctx).ID(),
+			OK:             size > 0,
+			BytesPerSecond: size / seconds,
+		})
+	}
+	if err := history.Append(measurements...); err != nil {
+		fmt.Println("Warning: could not save history:", err)
 	}
+}
 
-	os.RemoveAll(fmt.Sprintf("/tmp/%v", tempDir))
-	return nil
+// DownloadWithDNS downloads url through dns until ctx is done, the file is
+// complete or opts.MaxBytes were received, and returns the number of bytes
+// received. The data is discarded unless opts.KeepDir is set. progress, if
+// not nil, is called with the bytes received so far while downloading.
+func DownloadWithDNS(ctx context.Context, dns, url string, opts common.DownloadOptions, progress func(int64)) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error creating request for DNS %s: %w", dns, err)
+	}
+	resp, err := common.ChangeDNS(dns).Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("error downloading through DNS %s: %w", dns, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, fmt.Errorf("error downloading through DNS %s: %s", dns, resp.Status)
+	}
+
+	var dst io.Writer = io.Discard
+	if opts.KeepDir != "" {
+		file, err := opts.KeepFile(dns, path.Base(resp.Request.URL.Path))
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+		dst = file
+	}
+	var src io.Reader = resp.Body
+	if opts.MaxBytes > 0 {
+		src = io.LimitReader(src, opts.MaxBytes)
+	}
+
+	var received atomic.Int64
+	if progress != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			ticker := time.NewTicker(200 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					progress(received.Load())
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	_, err = io.Copy(dst, io.TeeReader(src, writerFunc(func(p []byte) (int, error) {
+		received.Add(int64(len(p)))
+		return len(p), nil
+	})))
+	if err != nil && ctx.Err() == nil {
+		return received.Load(), fmt.Errorf("error downloading through DNS %s: %w", dns, err)
+	}
+	return received.Load(), nil
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// Benchmark downloads url through each server in dnsList, one after the
+// other, for timeout each, and returns the bytes received per server,
+// extrapolated to the full timeout for downloads that finished early without
+// an error.
+// onResult, if not nil, is called after each server. When ctx is cancelled
+// it stops and returns only the servers that were fully measured.
+func Benchmark(ctx context.Context, url string, dnsList []string, timeout time.Duration, opts common.DownloadOptions, onResult func(dns string, size int64)) map[string]int64 {
+	dnsSizeMap := make(map[string]int64)
+	for _, dns := range dnsList {
+		if ctx.Err() != nil {
+			break
+		}
+		downloadCtx, cancel := context.WithTimeout(ctx, timeout)
+		started := time.Now()
+		size, err := DownloadWithDNS(downloadCtx, dns, url, opts, nil)
+		elapsed := time.Since(started)
+		cancel()
+		if ctx.Err() != nil {
+			// Interrupted before the timeout, the size says nothing about the server.
+			break
+		}
+		if err != nil {
+			// A download cut short by an error, like a reset after a block
+			// page, says nothing about the rate of the full file.
+			fmt.Fprintln(os.Stderr, err)
+		} else {
+			size = common.Extrapolate(size, elapsed, timeout)
+		}
+		dnsSizeMap[dns] = size
+		if onResult != nil {
+			onResult(dns, size)
+		}
+	}
+	return dnsSizeMap
 }
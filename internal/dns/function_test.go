@@ -1,7 +1,17 @@
 package dns
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
 
 	"gotest.tools/v3/assert"
 )
@@ -62,3 +72,66 @@ func TestIsValidHTTPURL(t *testing.T) {
 		})
 	}
 }
+
+func TestDownloadWithDNS(t *testing.T) {
+	payload := strings.Repeat("x", 10000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(payload))
+	}))
+	defer server.Close()
+	// The server is addressed by IP, so the DNS server is never queried.
+	url := server.URL + "/files/test.bin"
+
+	size, err := DownloadWithDNS(context.Background(), "127.0.0.1", url, common.DownloadOptions{}, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, int64(len(payload)), size)
+
+	size, err = DownloadWithDNS(context.Background(), "127.0.0.1", url, common.DownloadOptions{MaxBytes: 4096}, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, int64(4096), size)
+
+	dir := t.TempDir()
+	_, err = DownloadWithDNS(context.Background(), "127.0.0.1", url, common.DownloadOptions{KeepDir: dir}, nil)
+	assert.NilError(t, err)
+	kept, err := os.ReadFile(filepath.Join(dir, "127.0.0.1", "test.bin"))
+	assert.NilError(t, err)
+	assert.Equal(t, payload, string(kept))
+}
+
+func TestDownloadWithDNSErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	size, err := DownloadWithDNS(context.Background(), "127.0.0.1", server.URL, common.DownloadOptions{}, nil)
+	assert.ErrorContains(t, err, "403")
+	assert.Equal(t, int64(0), size)
+}
+
+func TestBenchmarkDoesNotExtrapolateErrors(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			// A few KB of a block page, then the connection is reset.
+			w.Header().Set("Content-Length", "1000000")
+			w.Write([]byte(strings.Repeat("x", 2000)))
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Header().Set("Content-Length", "20000")
+		for i := 0; i < 10; i++ {
+			w.Write([]byte(strings.Repeat("x", 2000)))
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	sizes := Benchmark(context.Background(), server.URL, []string{"127.0.0.1", "127.0.0.2"}, time.Second, common.DownloadOptions{}, nil)
+	assert.Equal(t, int64(2000), sizes["127.0.0.1"])
+	best, _ := Best(sizes)
+	assert.Equal(t, "127.0.0.2", best)
+}
@@ -0,0 +1,35 @@
+package docker
+
+import (
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/docker/docker-credential-helpers/client"
+)
+
+// This file and internal/notify/exec.go are the only places allowed to start
+// sub processes (see the depguard settings in .golangci.yml): credential
+// helpers are separate programs by design.
+
+// credentialHelper runs docker-credential-<helper> the way docker does.
+func credentialHelper(helper string) client.ProgramFunc {
+	return func(args ...string) client.Program {
+		cmd := exec.Command("docker-credential-"+helper, args...)
+		cmd.Stderr = os.Stderr
+		return helperProgram{cmd}
+	}
+}
+
+// helperProgram is a credential helper process.
+type helperProgram struct {
+	cmd *exec.Cmd
+}
+
+func (p helperProgram) Output() ([]byte, error) {
+	return p.cmd.Output()
+}
+
+func (p helperProgram) Input(in io.Reader) {
+	p.cmd.Stdin = in
+}
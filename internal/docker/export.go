@@ -0,0 +1,223 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+	"github.com/urfave/cli/v2"
+)
+
+// Mirror config formats written by fastdocker export.
+const (
+	// EXPORT_PODMAN is /etc/containers/registries.conf, read by podman,
+	// buildah, skopeo and CRI-O.
+	EXPORT_PODMAN = "podman"
+	// EXPORT_CONTAINERD is a hosts.toml in /etc/containerd/certs.d.
+	EXPORT_CONTAINERD = "containerd"
+	// EXPORT_BUILDKIT is /etc/buildkit/buildkitd.toml.
+	EXPORT_BUILDKIT = "buildkit"
+)
+
+// EXPORT_FORMATS lists every export format in the order they are written.
+var EXPORT_FORMATS = []string{EXPORT_PODMAN, EXPORT_CONTAINERD, EXPORT_BUILDKIT}
+
+// DEFAULT_EXPORT_ROOT is where export writes its files unless --root is given,
+// so they can be reviewed before they are copied to /.
+const DEFAULT_EXPORT_ROOT = "403unlocker-export"
+
+// Ranked returns the registries of the working, trusted results in the order
+// of results, at most top of them (all when top is 0).
+func Ranked(results []Result, registries []Registry, top int) []Registry {
+	var ranked []Registry
+	for _, result := range results {
+		if result.Err != nil || result.Bytes <= 0 {
+			continue
+		}
+		if top > 0 && len(ranked) == top {
+			break
+		}
+		ranked = append(ranked, Lookup(registries, result.Registry))
+	}
+	return ranked
+}
+
+// configHost returns the name container runtimes use for the registry
+// ggcr calls host, docker.io instead of index.docker.io.
+func configHost(host string) string {
+	if host == name.DefaultRegistry {
+		return "docker.io"
+	}
+	return host
+}
+
+// upstreamServer returns the URL of the upstream registry for hosts.toml.
+func upstreamServer(upstream string) string {
+	if upstream == "docker.io" {
+		return "https://registry-1.docker.io"
+	}
+	return "https://" + upstream
+}
+
+// mirrorPath returns the path below which mirror serves the repositories of
+// upstream, empty when it serves them at its root.
+func mirrorPath(mirror Registry, upstream string) string {
+	if upstream == "docker.io" {
+		return mirror.Prefix
+	}
+	if path := mirror.Namespaces[upstream]; path != "" {
+		return path
+	}
+	return upstream
+}
+
+func scheme(mirror Registry) string {
+	if mirror.PlainHTTP {
+		return "http"
+	}
+	return "https"
+}
+
+// ExportFiles renders the mirror configs of formats for pulling from upstream
+// (a registry host such as docker.io) through mirrors, in order of
+// preference. The result maps paths relative to the root file system to
+// their content.
+func ExportFiles(upstream string, mirrors []Registry, formats []string, header string) map[string]string {
+	files := make(map[string]string)
+	for _, format := range formats {
+		var b strings.Builder
+		b.WriteString(header)
+		switch format {
+		case EXPORT_PODMAN:
+			writePodman(&b, upstream, mirrors)
+			files["etc/containers/registries.conf"] = b.String()
+		case EXPORT_CONTAINERD:
+			writeContainerd(&b, upstream, mirrors)
+			files[filepath.Join("etc/containerd/certs.d", upstream, "hosts.toml")] = b.String()
+		case EXPORT_BUILDKIT:
+			writeBuildkit(&b, upstream, mirrors)
+			files["etc/buildkit/buildkitd.toml"] = b.String()
+		}
+	}
+	return files
+}
+
+func writePodman(b *strings.Builder, upstream string, mirrors []Registry) {
+	fmt.Fprintf(b, "[[registry]]\nprefix = %s\nlocation = %s\n", strconv.Quote(upstream), strconv.Quote(upstream))
+	for _, mirror := range mirrors {
+		location := mirror.Host
+		if path := mirrorPath(mirror, upstream); path != "" {
+			location += "/" + path
+		}
+		fmt.Fprintf(b, "\n[[registry.mirror]]\nlocation = %s\n", strconv.Quote(location))
+		if mirror.PlainHTTP || mirror.Insecure {
+			b.WriteString("insecure = true\n")
+		}
+		if mirror.NoLibrary && upstream == "docker.io" {
+			b.WriteString("# no-library cannot be expressed here, official images are requested with library/\n")
+		}
+	}
+}
+
+func writeContainerd(b *strings.Builder, upstream string, mirrors []Registry) {
+	fmt.Fprintf(b, "server = %s\n", strconv.Quote(upstreamServer(upstream)))
+	for _, mirror := range mirrors {
+		url := scheme(mirror) + "://" + mirror.Host
+		path := mirrorPath(mirror, upstream)
+		if path != "" {
+			url += "/v2/" + path
+		}
+		fmt.Fprintf(b, "\n[host.%s]\n  capabilities = [\"pull\", \"resolve\"]\n", strconv.Quote(url))
+		if path != "" {
+			b.WriteString("  override_path = true\n")
+		}
+		if mirror.Insecure {
+			b.WriteString("  skip_verify = true\n")
+		}
+		if mirror.CAFile != "" {
+			fmt.Fprintf(b, "  ca = %s\n", strconv.Quote(mirror.CAFile))
+		}
+	}
+}
+
+func writeBuildkit(b *strings.Builder, upstream string, mirrors []Registry) {
+	locations := make([]string, len(mirrors))
+	for i, mirror := range mirrors {
+		locations[i] = mirror.Host
+		if path := mirrorPath(mirror, upstream); path != "" {
+			locations[i] += "/" + path
+		}
+		locations[i] = strconv.Quote(locations[i])
+	}
+	fmt.Fprintf(b, "[registry.%s]\n  mirrors = [%s]\n", strconv.Quote(upstream), strings.Join(locations, ", "))
+	for _, mirror := range mirrors {
+		if !mirror.PlainHTTP && !mirror.Insecure && mirror.CAFile == "" {
+			continue
+		}
+		fmt.Fprintf(b, "\n[registry.%s]\n", strconv.Quote(mirror.Host))
+		if mirror.PlainHTTP {
+			b.WriteString("  http = true\n")
+		}
+		if mirror.Insecure {
+			b.WriteString("  insecure = true\n")
+		}
+		if mirror.CAFile != "" {
+			fmt.Fprintf(b, "  ca = [%s]\n", strconv.Quote(mirror.CAFile))
+		}
+	}
+}
+
+// WriteExport writes files below root and returns the paths written, sorted.
+func WriteExport(root string, files map[string]string) ([]string, error) {
+	paths := make([]string, 0, len(files))
+	for path, content := range files {
+		path = filepath.Join(root, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// ExportWithDockerImage ranks the registries like fastdocker and writes the
+// best ones as mirror configs for podman, containerd and BuildKit below --root.
+func ExportWithDockerImage(c *cli.Context) error {
+	results, registries, err := rankRegistries(c)
+	if err != nil {
+		return err
+	}
+	ranked := Ranked(results, registries, c.Int("top"))
+	if len(ranked) == 0 {
+		fmt.Println("Nothing to export.")
+		return nil
+	}
+	ref, err := name.ParseReference(c.Args().First())
+	if err != nil {
+		return fmt.Errorf("%w: %v", common.ErrInvalidInput, err)
+	}
+	upstream := configHost(ref.Context().RegistryStr())
+
+	header := fmt.Sprintf("# Written by 403unlocker on %s from the fastdocker ranking of %s.\n# Review before copying to /.\n\n",
+		time.Now().Format(time.RFC3339), c.Args().First())
+	files := ExportFiles(upstream, ranked, c.StringSlice("format"), header)
+	paths, err := WriteExport(c.String("root"), files)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nMirrors for %s: %s\n", upstream, strings.Join(Hosts(ranked), ", "))
+	for _, path := range paths {
+		fmt.Printf("Wrote %s\n", path)
+	}
+	return nil
+}
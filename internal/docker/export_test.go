@@ -0,0 +1,99 @@
+package docker
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRanked(t *testing.T) {
+	registries, err := ParseRegistries(strings.Fields("a.example.com b.example.com plain-http c.example.com d.example.com"))
+	assert.NoError(t, err)
+	results := []Result{
+		{Registry: "b.example.com", Bytes: 300},
+		{Registry: "d.example.com", Bytes: 200},
+		{Registry: "a.example.com", Bytes: 100},
+		{Registry: "c.example.com", Err: ErrDigestMismatch},
+		{Registry: "e.example.com", Err: errors.New("timeout")},
+	}
+
+	ranked := Ranked(results, registries, 2)
+	assert.Equal(t, []string{"b.example.com", "d.example.com"}, Hosts(ranked))
+	assert.True(t, ranked[0].PlainHTTP)
+	assert.Equal(t, []string{"b.example.com", "d.example.com", "a.example.com"}, Hosts(Ranked(results, registries, 0)))
+}
+
+func TestExportFiles(t *testing.T) {
+	mirrors, err := ParseRegistries(strings.Fields(`fast.example.com
+local.example.com:5000 plain-http
+harbor.example.com prefix=dockerhub map=ghcr.io:ghcr insecure ca-file=/etc/ssl/harbor.pem`))
+	assert.NoError(t, err)
+
+	files := ExportFiles("docker.io", mirrors, EXPORT_FORMATS, "# header\n\n")
+	assert.Equal(t, `# header
+
+[[registry]]
+prefix = "docker.io"
+location = "docker.io"
+
+[[registry.mirror]]
+location = "fast.example.com"
+
+[[registry.mirror]]
+location = "local.example.com:5000"
+insecure = true
+
+[[registry.mirror]]
+location = "harbor.example.com/dockerhub"
+insecure = true
+`, files["etc/containers/registries.conf"])
+
+	assert.Equal(t, `# header
+
+server = "https://registry-1.docker.io"
+
+[host."https://fast.example.com"]
+  capabilities = ["pull", "resolve"]
+
+[host."http://local.example.com:5000"]
+  capabilities = ["pull", "resolve"]
+
+[host."https://harbor.example.com/v2/dockerhub"]
+  capabilities = ["pull", "resolve"]
+  override_path = true
+  skip_verify = true
+  ca = "/etc/ssl/harbor.pem"
+`, files["etc/containerd/certs.d/docker.io/hosts.toml"])
+
+	assert.Equal(t, `# header
+
+[registry."docker.io"]
+  mirrors = ["fast.example.com", "local.example.com:5000", "harbor.example.com/dockerhub"]
+
+[registry."local.example.com:5000"]
+  http = true
+
+[registry."harbor.example.com"]
+  insecure = true
+  ca = ["/etc/ssl/harbor.pem"]
+`, files["etc/buildkit/buildkitd.toml"])
+
+	files = ExportFiles("ghcr.io", mirrors, []string{EXPORT_CONTAINERD}, "")
+	assert.Len(t, files, 1)
+	hosts := files["etc/containerd/certs.d/ghcr.io/hosts.toml"]
+	assert.Contains(t, hosts, `server = "https://ghcr.io"`)
+	assert.Contains(t, hosts, `[host."https://fast.example.com/v2/ghcr.io"]`)
+	assert.Contains(t, hosts, `[host."https://harbor.example.com/v2/ghcr"]`)
+
+	root := t.TempDir()
+	paths, err := WriteExport(root, files)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(root, "etc/containerd/certs.d/ghcr.io/hosts.toml")}, paths)
+	written, err := os.ReadFile(paths[0])
+	assert.NoError(t, err)
+	assert.Equal(t, hosts, string(written))
+}
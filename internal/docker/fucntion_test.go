@@ -1,8 +1,24 @@
 package docker
 
 import (
+	"context"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -35,3 +51,188 @@ func TestValidateDockerImageName(t *testing.T) {
 		})
 	}
 }
+
+var amd64 = v1.Platform{OS: "linux", Architecture: "amd64"}
+
+// testRegistry serves a random image as library/test:latest.
+func testRegistry(t *testing.T) string {
+	t.Helper()
+	img, err := random.Image(64<<10, 3)
+	assert.NoError(t, err)
+	return imageRegistry(t, img)
+}
+
+// imageRegistry serves img as library/test:latest.
+func imageRegistry(t *testing.T, img v1.Image) string {
+	t.Helper()
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	ref, err := name.ParseReference(host + "/library/test:latest")
+	assert.NoError(t, err)
+	assert.NoError(t, remote.Write(ref, img))
+	return host
+}
+
+func TestMeasureRegistry(t *testing.T) {
+	host := testRegistry(t)
+
+	phases, err := MeasureRegistry(context.Background(), "library/test:latest", amd64, Registry{Host: host}, common.DownloadOptions{})
+	assert.NoError(t, err)
+	assert.Greater(t, phases.BlobSize, int64(64<<10))
+	assert.Equal(t, phases.BlobSize, phases.BlobBytes)
+	assert.NotEmpty(t, phases.Blob.Hex)
+	assert.Positive(t, phases.Manifest)
+
+	phases, err = MeasureRegistry(context.Background(), "library/test:latest", amd64, Registry{Host: host}, common.DownloadOptions{MaxBytes: 1024})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1024), phases.BlobBytes)
+
+	dir := t.TempDir()
+	phases, err = MeasureRegistry(context.Background(), "library/test:latest", amd64, Registry{Host: host}, common.DownloadOptions{KeepDir: dir})
+	assert.NoError(t, err)
+	info, err := os.Stat(filepath.Join(dir, strings.ReplaceAll(host, ":", "_"), phases.Blob.Hex))
+	if assert.NoError(t, err) {
+		assert.Equal(t, phases.BlobSize, info.Size())
+	}
+
+	_, err = MeasureRegistry(context.Background(), "library/missing:latest", amd64, Registry{Host: host}, common.DownloadOptions{})
+	assert.ErrorContains(t, err, "manifest")
+}
+
+func TestBenchmarkMeasuresTheSameBlob(t *testing.T) {
+	img, err := random.Image(64<<10, 3)
+	assert.NoError(t, err)
+	first, stale, second := imageRegistry(t, img), testRegistry(t), imageRegistry(t, img)
+	registries := []Registry{{Host: "127.0.0.1:1"}, {Host: first}, {Host: stale}, {Host: second}}
+
+	results := Benchmark(context.Background(), "library/test:latest", amd64, registries, 5*time.Second, common.DownloadOptions{}, nil)
+	assert.Len(t, results, 4)
+	assert.Error(t, results[0].Err)
+	assert.NoError(t, results[1].Err)
+	assert.True(t, isNotFound(results[2].Err), "the stale registry does not have the layer of the first one")
+	assert.NoError(t, results[3].Err)
+	assert.Equal(t, results[1].Phases.Blob, results[3].Phases.Blob)
+	assert.True(t, results[3].Phases.BlobVerified)
+}
+
+func TestMeasureRegistryIndex(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	arm, err := random.Image(1024, 1)
+	assert.NoError(t, err)
+	amd, err := random.Image(4096, 2)
+	assert.NoError(t, err)
+	index := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: arm, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}}},
+		mutate.IndexAddendum{Add: amd, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}},
+	)
+	ref, err := name.ParseReference(host + "/library/multi:latest")
+	assert.NoError(t, err)
+	assert.NoError(t, remote.WriteIndex(ref, index))
+
+	phases, err := MeasureRegistry(context.Background(), "library/multi:latest", amd64, Registry{Host: host}, common.DownloadOptions{})
+	assert.NoError(t, err)
+	assert.Greater(t, phases.BlobSize, int64(4096), "the amd64 layer is measured")
+	assert.Equal(t, []string{"linux/arm64", "linux/amd64"}, phases.Platforms)
+
+	arm64 := v1.Platform{OS: "linux", Architecture: "arm64"}
+	phases, err = MeasureRegistry(context.Background(), "library/multi:latest", arm64, Registry{Host: host}, common.DownloadOptions{})
+	assert.NoError(t, err)
+	assert.Less(t, phases.BlobSize, int64(4096), "the arm64 layer is measured")
+
+	s390x := v1.Platform{OS: "linux", Architecture: "s390x"}
+	phases, err = MeasureRegistry(context.Background(), "library/multi:latest", s390x, Registry{Host: host}, common.DownloadOptions{})
+	assert.ErrorContains(t, err, "available for linux/arm64, linux/amd64")
+	assert.Len(t, phases.Platforms, 2)
+}
+
+// withPlatform sets the platform in the config of img.
+func withPlatform(t *testing.T, img v1.Image, goos, architecture string) v1.Image {
+	t.Helper()
+	config, err := img.ConfigFile()
+	assert.NoError(t, err)
+	config = config.DeepCopy()
+	config.OS, config.Architecture = goos, architecture
+	img, err = mutate.ConfigFile(img, config)
+	assert.NoError(t, err)
+	return img
+}
+
+func TestMeasureRegistrySinglePlatform(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	img, err := random.Image(1024, 1)
+	assert.NoError(t, err)
+	img = withPlatform(t, img, "linux", "arm64")
+	ref, err := name.ParseReference(host + "/library/arm:latest")
+	assert.NoError(t, err)
+	assert.NoError(t, remote.Write(ref, img))
+
+	phases, err := MeasureRegistry(context.Background(), "library/arm:latest", v1.Platform{OS: "linux", Architecture: "arm64"}, Registry{Host: host}, common.DownloadOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"linux/arm64"}, phases.Platforms)
+
+	phases, err = MeasureRegistry(context.Background(), "library/arm:latest", amd64, Registry{Host: host}, common.DownloadOptions{})
+	assert.ErrorContains(t, err, "only available for linux/arm64")
+	assert.Equal(t, []string{"linux/arm64"}, phases.Platforms)
+}
+
+func TestInspectRegistry(t *testing.T) {
+	host := testRegistry(t)
+	ref, err := name.ParseReference(host + "/library/test:latest")
+	assert.NoError(t, err)
+	desc, err := remote.Get(ref)
+	assert.NoError(t, err)
+
+	img, err := random.Image(1024, 1)
+	assert.NoError(t, err)
+	img = withPlatform(t, img, "linux", "arm64")
+	proxied, err := name.ParseReference(host + "/ghcr.io/test/proxied:latest")
+	assert.NoError(t, err)
+	assert.NoError(t, remote.Write(proxied, img))
+
+	saved := namespaceProbes
+	defer func() { namespaceProbes = saved }()
+	namespaceProbes = []namespaceProbe{{"ghcr.io", "ghcr.io/test/proxied:latest"}, {"quay.io", "quay.io/test/missing:latest"}}
+
+	inspection := InspectRegistry(context.Background(), "library/test:latest", Registry{Host: host})
+	assert.NoError(t, inspection.Err)
+	assert.True(t, inspection.Exists)
+	assert.Equal(t, desc.Digest, inspection.Digest)
+	assert.Equal(t, []string{"ghcr.io"}, inspection.Namespaces)
+	assert.Equal(t, TAG_CURRENT, inspection.Tag(desc.Digest))
+	assert.Equal(t, TAG_UNVERIFIED, inspection.Tag(v1.Hash{}))
+	assert.Equal(t, TAG_STALE, inspection.Tag(v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("0", 64)}))
+
+	inspection = InspectRegistry(context.Background(), "ghcr.io/test/proxied:latest", Registry{Host: host})
+	assert.NoError(t, inspection.Err)
+	assert.Equal(t, []string{"linux/arm64"}, inspection.Platforms)
+
+	inspection = InspectRegistry(context.Background(), "library/missing:latest", Registry{Host: host})
+	assert.NoError(t, inspection.Err)
+	assert.False(t, inspection.Exists)
+	assert.Equal(t, TAG_MISSING, inspection.Tag(desc.Digest))
+
+	digest, err := ReferenceDigest(context.Background(), "library/test:latest", Registry{Host: host})
+	assert.NoError(t, err)
+	assert.Equal(t, desc.Digest, digest)
+}
+
+func TestInspectSummary(t *testing.T) {
+	reference := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}
+	results := []Inspection{
+		{Registry: "a", Exists: true, Digest: reference},
+		{Registry: "b", Exists: true, Digest: v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("b", 64)}},
+		{Registry: "c", Exists: true, Digest: reference},
+		{Registry: "d"},
+		{Registry: "e", Err: context.DeadlineExceeded},
+	}
+	assert.Equal(t, "2 current, 1 stale, 1 missing, 1 failed", InspectSummary(results, reference))
+	assert.Equal(t, "3 unverified, 1 missing, 1 failed", InspectSummary(results, v1.Hash{}))
+}
@@ -2,22 +2,18 @@ package docker
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
-	"os"
-	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
-	"sync/atomic"
 	"time"
 
-	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/name"
-	"github.com/google/go-containerregistry/pkg/v1/remote"
-	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/salehborhani/403Unlocker-cli/internal/common"
+	"github.com/salehborhani/403Unlocker-cli/internal/history"
+	"github.com/salehborhani/403Unlocker-cli/internal/network"
 	"github.com/urfave/cli/v2"
 )
 
@@ -32,155 +28,279 @@ func DockerImageValidator(imageName string) bool {
 	return regex.MatchString(imageName) && !strings.Contains(imageName, "@@")
 }
 
-// customTransport tracks the number of bytes transferred during HTTP requests.
-type customTransport struct {
-	Transport http.RoundTripper
-	Bytes     int64
+// Result is the outcome of pulling an image from one registry.
+type Result struct {
+	Registry string
+	// Bytes of the largest layer the registry delivers in the timeout.
+	Bytes  int64
+	Phases Phases
+	Err    error
 }
 
-// RoundTrip implements the http.RoundTripper interface and wraps the response body to count bytes read.
-func (c *customTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	resp, err := c.Transport.RoundTrip(req)
-	if err != nil {
-		return nil, err
+// Benchmark measures imageName for platform on every registry in registries, one after
+// the other, for timeout each (see MeasureRegistry). The layer picked from the
+// manifest of the first registry that serves the image without an error is
+// downloaded from every later registry, so all of them are compared on the
+// same blob, and registries that do not have it fail as not found. Bytes are
+// extrapolated to the full timeout for layers that finished early without an
+// error. onResult, if not nil, is called after each
+// registry. When ctx is cancelled it stops and returns only the registries
+// that were fully measured.
+func Benchmark(ctx context.Context, imageName string, platform v1.Platform, registries []Registry, timeout time.Duration, opts common.DownloadOptions, onResult func(Result)) []Result {
+	results := make([]Result, 0, len(registries))
+	var blob *v1.Descriptor
+	for _, registry := range registries {
+		if ctx.Err() != nil {
+			break
+		}
+		pullCtx, cancel := context.WithTimeout(ctx, timeout)
+		phases, err := measureRegistry(pullCtx, imageName, platform, registry, blob, opts)
+		cancel()
+		if ctx.Err() != nil {
+			// Interrupted before the timeout, the size says nothing about the registry.
+			break
+		}
+
+		result := Result{
+			Registry: registry.Host,
+			Bytes:    phases.BlobBytes,
+			Phases:   phases,
+			Err:      err,
+		}
+		if err == nil {
+			result.Bytes = common.Extrapolate(phases.BlobBytes, phases.BlobTime, timeout)
+			if blob == nil {
+				blob = &v1.Descriptor{Digest: phases.Blob, Size: phases.BlobSize}
+			}
+		}
+		results = append(results, result)
+		if onResult != nil {
+			onResult(result)
+		}
 	}
-	resp.Body = &countingReader{inner: resp.Body, Bytes: &c.Bytes}
-	return resp, nil
+	return results
 }
 
-// countingReader wraps an io.ReadCloser and counts the bytes read.
-type countingReader struct {
-	inner io.ReadCloser
-	Bytes *int64
+func shorten(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
 }
 
-func (cr *countingReader) Read(p []byte) (int, error) {
-	n, err := cr.inner.Read(p)
-	atomic.AddInt64(cr.Bytes, int64(n))
-	return n, err
+func formatPhase(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return d.Round(time.Millisecond).String()
 }
 
-func (cr *countingReader) Close() error {
-	return cr.inner.Close()
+// measuredBlob describes the layer the registries were measured on, which
+// Benchmark downloads from all of them.
+func measuredBlob(results []Result) string {
+	for _, result := range results {
+		if result.Err == nil && result.Phases.BlobSize > 0 {
+			return fmt.Sprintf("%s (%s)", result.Phases.Blob, common.FormatDataSize(result.Phases.BlobSize))
+		}
+	}
+	return ""
 }
 
-// DownloadDockerImage downloads a Docker image from a registry and tracks the bytes downloaded.
-func DownloadDockerImage(ctx context.Context, imageName, registry, outputPath string) (int64, error) {
-
-	fullImageName := registry + "/" + imageName
-
-	// Parse the image reference.
-	ref, err := name.ParseReference(fullImageName)
-	if err != nil {
-		return 0, fmt.Errorf("failed to parse image reference: %v", err)
+func untrustedRegistries(results []Result) []string {
+	var untrusted []string
+	for _, result := range results {
+		if result.Untrusted() {
+			untrusted = append(untrusted, result.Registry)
+		}
 	}
+	return untrusted
+}
 
-	auth := authn.DefaultKeychain
-	transport := &customTransport{Transport: http.DefaultTransport}
+// SortResults orders results by downloaded data, failed registries last and
+// ties by name.
+func SortResults(results []Result) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if (a.Err == nil) != (b.Err == nil) {
+			return a.Err == nil
+		}
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Registry < b.Registry
+	})
+}
 
-	img, err := remote.Image(ref, remote.WithAuthFromKeychain(auth), remote.WithContext(ctx), remote.WithTransport(transport))
-	if err != nil {
-		return transport.Bytes, fmt.Errorf("failed to download image: %v", err)
+// Best returns the registry that downloaded the most data, if any did.
+func Best(results []Result) (string, int64) {
+	var maxRegistry string
+	var maxSize int64
+	for _, result := range results {
+		if result.Err == nil && result.Bytes > maxSize {
+			maxRegistry = result.Registry
+			maxSize = result.Bytes
+		}
 	}
+	return maxRegistry, maxSize
+}
 
-	// Ensure output directory exists.
-	if err := os.MkdirAll(outputPath, 0755); err != nil {
-		return transport.Bytes, fmt.Errorf("failed to create output directory: %v", err)
+// RecordHistory stores the result of benchmarking imageName in the history database.
+func RecordHistory(ctx context.Context, imageName string, started time.Time, timeout time.Duration, results []Result) {
+	seconds := int64(timeout / time.Second)
+	if seconds < 1 {
+		seconds = 1
 	}
-
-	// Save the image as a tarball.
-	tarballPath := filepath.Join(outputPath, filepath.Base(imageName)+".tar")
-	if err := tarball.WriteToFile(tarballPath, ref, img); err != nil {
-		return transport.Bytes, nil
+	measurements := make([]history.Measurement, 0, len(results))
+	for _, result := range results {
+		measurement := history.Measurement{
+			Time:    started,
+			Kind:    history.KIND_FASTDOCKER,
+			Target:  imageName,
+			Server:  result.Registry,
+			Network: network.Current(ctx).ID(),
+		}
+		if result.Untrusted() {
+			measurement.Status = "untrusted"
+		} else if result.Err != nil {
+			measurement.Status = "failed"
+		} else {
+			measurement.OK = result.Bytes > 0
+			measurement.BytesPerSecond = result.Bytes / seconds
+		}
+		measurements = append(measurements, measurement)
 	}
+	if err := history.Append(measurements...); err != nil {
+		fmt.Println("Warning: could not save history:", err)
+	}
+}
 
-	return transport.Bytes, nil
+// PlatformFlag returns the platform given with --platform, or DefaultPlatform.
+func PlatformFlag(c *cli.Context) (v1.Platform, error) {
+	value := c.String("platform")
+	if value == "" {
+		return DefaultPlatform(), nil
+	}
+	platform, err := v1.ParsePlatform(value)
+	if err != nil {
+		return v1.Platform{}, fmt.Errorf("%w: --platform: %v", common.ErrInvalidInput, err)
+	}
+	return *platform, nil
 }
 
 // CheckWithDockerImage downloads the image from multiple registries and reports the downloaded data size.
 func CheckWithDockerImage(c *cli.Context) error {
-	registrySizeMap := make(map[string]int64)
+	_, _, err := rankRegistries(c)
+	return err
+}
+
+// rankRegistries benchmarks the image in the first argument on every
+// registry, prints the ranking and returns the sorted results with the
+// registries they were measured on.
+func rankRegistries(c *cli.Context) ([]Result, []Registry, error) {
 	timeout := c.Int("timeout")
 	imageName := c.Args().First()
-	tempDir := time.Now().UnixMilli()
+	platform, err := PlatformFlag(c)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	fmt.Printf("\nTimeout: %d seconds\n", timeout)
-	fmt.Printf("Docker Image: %s\n\n", imageName)
+	fmt.Printf("Docker Image: %s\n", imageName)
+	fmt.Printf("Platform: %s\n\n", platform)
 
 	if imageName == "" {
-		return fmt.Errorf("image name cannot be empty")
+		return nil, nil, fmt.Errorf("image name cannot be empty")
 	}
 
-	registryList, err := common.ReadDNSFromFile(common.DOCKER_CONFIG_FILE)
+	registries, err := ReadRegistries()
 	if err != nil {
-		err = common.DownloadConfigFile(common.DOCKER_CONFIG_URL, common.DOCKER_CONFIG_FILE)
-		if err != nil {
-			return err
-		}
-
-		registryList, err = common.ReadDNSFromFile(common.DOCKER_CONFIG_FILE)
-		if err != nil {
-			log.Printf("Error reading registry list: %v", err)
-			return err
-		}
-
+		log.Printf("Error reading registry list: %v", err)
+		return nil, nil, err
 	}
 
-	// Find the longest registry name first
-	maxLength := 0
-	for _, registry := range registryList {
-		if len(registry) > maxLength {
-			maxLength = len(registry)
+	// Every registry is asked for the same manifest by digest, so what it
+	// serves can be verified.
+	pullName := imageName
+	expected, source, err := ExpectedDigest(c, imageName, registries, time.Duration(timeout)*time.Second)
+	switch {
+	case errors.Is(err, common.ErrInvalidInput):
+		return nil, nil, err
+	case err != nil:
+		fmt.Printf("Expected digest: unavailable (%s), only the layers are verified; pass --digest or --reference to verify manifests\n", shorten(err.Error(), 80))
+	default:
+		if pullName, err = Pin(imageName, expected); err != nil {
+			return nil, nil, err
 		}
+		fmt.Printf("Expected digest: %s (from %s)\n", expected, source)
 	}
 
-	// Create table formatting based on longest name
-	borderLine := "+" + strings.Repeat("-", maxLength+2) + "+------------------+"
-	format := "| %-" + fmt.Sprintf("%d", maxLength) + "s | %-16s |\n"
-
-	// Print table header
-	fmt.Println(borderLine)
-	fmt.Printf(format, "Registry", "Download Speed")
-	fmt.Println(borderLine)
+	fmt.Printf("Pulling from %d registries...\n\n", len(registries))
 
-	for _, registry := range registryList {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
-		defer cancel()
-
-		size, err := DownloadDockerImage(ctx, imageName, registry, fmt.Sprintf("/tmp/%v", tempDir))
-		if err != nil {
-			fmt.Printf("| %-*s | %s%-16s%s |\n",
-				maxLength, registry,
-				common.Red, "failed", common.Reset)
+	maxBytes, err := common.ParseDataSize(c.String("max-bytes"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: --max-bytes: %v", common.ErrInvalidInput, err)
+	}
+	opts := common.DownloadOptions{KeepDir: c.String("keep"), MaxBytes: maxBytes}
+
+	started := time.Now()
+	done := 0
+	results := Benchmark(c.Context, pullName, platform, registries, time.Duration(timeout)*time.Second, opts, func(Result) {
+		done++
+		common.Progress("Pulled", done, len(registries))
+	})
+	interrupted := common.Interrupted(c.Context)
+	if interrupted != nil {
+		common.ClearProgress()
+		fmt.Printf("\nInterrupted after %d of %d registries, the ranking below is partial.\n\n", len(results), len(registries))
+	}
+	SortResults(results)
+
+	table := common.NewTable("Registry", "Auth", "Manifest", "Platforms", "Download Speed", "Error")
+	for _, result := range results {
+		auth, manifest := formatPhase(result.Phases.Auth), formatPhase(result.Phases.Manifest)
+		platforms := shorten(orDash(result.Phases.Platforms), 40)
+		if result.Err != nil {
+			status := "failed"
+			switch {
+			case result.Untrusted():
+				status = "untrusted"
+			case isNotFound(result.Err):
+				status = "missing"
+			}
+			table.AddRow(common.Plain(result.Registry), common.Plain(auth), common.Plain(manifest), common.Plain(platforms),
+				common.Colored(common.Red, status), common.Plain(shorten(result.Err.Error(), 80)))
 			continue
 		}
-
-		registrySizeMap[registry] += size
-		speed := common.FormatDataSize(size / int64(timeout))
-		fmt.Printf(format, registry, speed+"/s")
+		speed := common.FormatDataSize(result.Bytes / int64(timeout))
+		table.AddRow(common.Plain(result.Registry), common.Plain(auth), common.Plain(manifest), common.Plain(platforms), common.Plain(speed+"/s"))
+	}
+	table.Print()
+	if blob := measuredBlob(results); blob != "" {
+		fmt.Printf("Measured on layer %s\n", blob)
+	}
+	if untrusted := untrustedRegistries(results); len(untrusted) > 0 {
+		fmt.Printf("%s served content that does not match its digest, do not pull from them\n",
+			common.Colorize(common.Red, "Untrusted: "+strings.Join(untrusted, ", ")))
 	}
 
-	fmt.Println(borderLine)
+	RecordHistory(c.Context, imageName, started, time.Duration(timeout)*time.Second, results)
 
-	var maxRegistry string
-	var maxSize int64
-	for registry, size := range registrySizeMap {
-		if size > maxSize {
-			maxRegistry = registry
-			maxSize = size
-		}
-	}
+	maxRegistry, maxSize := Best(results)
 
 	fmt.Println()
 	if maxRegistry != "" {
 		bestSpeed := common.FormatDataSize(maxSize / int64(timeout))
-		fmt.Printf("Best Registry: %s%s%s (%s%s/s%s)\n",
-			common.Green, maxRegistry, common.Reset,
-			common.Green, bestSpeed, common.Reset)
+		fmt.Printf("Best Registry: %s (%s)\n",
+			common.Colorize(common.Green, maxRegistry), common.Colorize(common.Green, bestSpeed+"/s"))
 	} else {
 		fmt.Println("No registry was able to download any data.")
 	}
+	if interrupted != nil {
+		return results, registries, interrupted
+	}
+	if maxRegistry == "" && c.Bool("fail-if-none") {
+		return results, registries, fmt.Errorf("%w: no registry could serve %s", common.ErrNoneWorked, imageName)
+	}
 
-	os.RemoveAll(fmt.Sprintf("/tmp/%v", tempDir))
-	return nil
+	return results, registries, nil
 }
@@ -0,0 +1,274 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+	"github.com/urfave/cli/v2"
+)
+
+// Tag states reported by registry inspect.
+const (
+	TAG_CURRENT = "current"
+	TAG_STALE   = "stale"
+	TAG_MISSING = "missing"
+	// TAG_UNVERIFIED means the tag exists but there is no reference digest
+	// to compare it with.
+	TAG_UNVERIFIED = "unverified"
+	TAG_FAILED     = "failed"
+	// TAG_UNTRUSTED means the registry served content that does not match
+	// its digest.
+	TAG_UNTRUSTED = "untrusted"
+)
+
+// namespaceProbe is a small image known to exist on an upstream registry
+// other than Docker Hub. A mirror proxies that registry if it serves the
+// image under <mirror>/<image>.
+type namespaceProbe struct {
+	Namespace string
+	Image     string
+}
+
+var namespaceProbes = []namespaceProbe{
+	{"ghcr.io", "ghcr.io/containerd/busybox:1.36"},
+	{"quay.io", "quay.io/prometheus/busybox:latest"},
+	{"gcr.io", "gcr.io/distroless/static:latest"},
+}
+
+// Inspection is what a registry serves for an image.
+type Inspection struct {
+	Registry string
+	// Exists is false when the registry answered that the tag is unknown.
+	Exists bool
+	// Digest of the top level manifest, the index for multi-platform images.
+	Digest    v1.Hash
+	Platforms []string
+	// Namespaces are the upstream registries besides Docker Hub the
+	// registry proxies.
+	Namespaces []string
+	Err        error
+}
+
+// Tag compares the inspected tag with the reference digest, which may be
+// empty when the upstream registry could not be reached.
+func (i Inspection) Tag(reference v1.Hash) string {
+	switch {
+	case errors.Is(i.Err, ErrDigestMismatch):
+		return TAG_UNTRUSTED
+	case i.Err != nil:
+		return TAG_FAILED
+	case !i.Exists:
+		return TAG_MISSING
+	case reference == v1.Hash{}:
+		return TAG_UNVERIFIED
+	case i.Digest == reference:
+		return TAG_CURRENT
+	}
+	return TAG_STALE
+}
+
+// InspectRegistry reports whether registry serves imageName, which digest and
+// platforms it serves, and which namespaces in namespaceProbes it proxies.
+func InspectRegistry(ctx context.Context, imageName string, registry Registry) Inspection {
+	inspection := Inspection{Registry: registry.Host}
+	ref, err := registry.Reference(imageName)
+	if err != nil {
+		inspection.Err = err
+		return inspection
+	}
+	inspection.Digest, inspection.Platforms, err = manifestInfo(ctx, ref, registry)
+	switch {
+	case isNotFound(err):
+	case err != nil:
+		inspection.Err = err
+		return inspection
+	default:
+		inspection.Exists = true
+	}
+
+	for _, probe := range namespaceProbes {
+		ref, err := registry.Reference(probe.Image)
+		if err != nil {
+			continue
+		}
+		if _, _, err := manifestInfo(ctx, ref, registry); err == nil {
+			inspection.Namespaces = append(inspection.Namespaces, probe.Namespace)
+		}
+	}
+	return inspection
+}
+
+// ReferenceDigest returns the manifest digest of imageName on reference, or
+// on the registry named in imageName (Docker Hub by default) when reference
+// has no host.
+func ReferenceDigest(ctx context.Context, imageName string, reference Registry) (v1.Hash, error) {
+	ref, err := reference.Reference(imageName)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	digest, _, err := manifestInfo(ctx, ref, reference)
+	return digest, err
+}
+
+// manifestInfo returns the digest of the manifest of ref on registry and the
+// platforms it serves, read from the index or, for single-platform images,
+// the config.
+func manifestInfo(ctx context.Context, ref name.Reference, registry Registry) (v1.Hash, []string, error) {
+	repo := ref.Context()
+	client, err := connect(ctx, repo, registry)
+	if err != nil {
+		return v1.Hash{}, nil, err
+	}
+	body, mediaType, err := get(ctx, client, repo, "manifests/"+ref.Identifier())
+	if err != nil {
+		return v1.Hash{}, nil, err
+	}
+	digest, _, err := v1.SHA256(bytes.NewReader(body))
+	if err != nil {
+		return v1.Hash{}, nil, err
+	}
+	if expected, ok := ref.(name.Digest); ok && digest.String() != expected.DigestStr() {
+		return digest, nil, fmt.Errorf("%w: manifest %s has digest %s", ErrDigestMismatch, expected.DigestStr(), digest)
+	}
+
+	if mediaType.IsIndex() {
+		index, err := v1.ParseIndexManifest(bytes.NewReader(body))
+		if err != nil {
+			return digest, nil, err
+		}
+		return digest, indexPlatforms(index), nil
+	}
+	manifest, err := v1.ParseManifest(bytes.NewReader(body))
+	if err != nil {
+		return digest, nil, err
+	}
+	platform, err := configPlatform(ctx, client, repo, manifest)
+	if err != nil || platform == nil {
+		return digest, nil, err
+	}
+	return digest, []string{platform.String()}, nil
+}
+
+func isNotFound(err error) bool {
+	var terr *transport.Error
+	return errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound
+}
+
+// Inspect inspects imageName on every registry in registries concurrently,
+// for at most timeout each. onResult, if not nil, is called as soon as each
+// registry finishes. Results are in the order of registries.
+func Inspect(ctx context.Context, imageName string, registries []Registry, timeout time.Duration, onResult func(Inspection)) []Inspection {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	results := make([]Inspection, len(registries))
+	for i, registry := range registries {
+		wg.Add(1)
+		go func(i int, registry Registry) {
+			defer wg.Done()
+			inspectCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			result := InspectRegistry(inspectCtx, imageName, registry)
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[i] = result
+			if onResult != nil {
+				onResult(result)
+			}
+		}(i, registry)
+	}
+	wg.Wait()
+	return results
+}
+
+// InspectSummary counts inspections per tag state, e.g. "3 current, 1 stale".
+func InspectSummary(results []Inspection, reference v1.Hash) string {
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result.Tag(reference)]++
+	}
+	var parts []string
+	for _, tag := range []string{TAG_CURRENT, TAG_STALE, TAG_UNVERIFIED, TAG_MISSING, TAG_UNTRUSTED, TAG_FAILED} {
+		if counts[tag] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[tag], tag))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func shortDigest(digest v1.Hash) string {
+	if len(digest.Hex) < 12 {
+		return "-"
+	}
+	return digest.Algorithm + ":" + digest.Hex[:12]
+}
+
+func orDash(values []string) string {
+	if len(values) == 0 {
+		return "-"
+	}
+	return strings.Join(values, ", ")
+}
+
+// InspectWithDockerImage reports, for every registry, whether it serves the
+// image tag, whether the tag is up to date with the upstream registry, the
+// platforms served and the other registries it proxies.
+func InspectWithDockerImage(c *cli.Context) error {
+	timeout := time.Duration(c.Int("timeout")) * time.Second
+	imageName := c.Args().First()
+
+	registries, err := ReadRegistries()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\nDocker Image: %s\n", imageName)
+	reference, source, err := ExpectedDigest(c, imageName, registries, timeout)
+	switch {
+	case errors.Is(err, common.ErrInvalidInput):
+		return err
+	case err != nil:
+		reference = v1.Hash{}
+		fmt.Printf("Reference digest: unavailable (%s), pass --digest or --reference to compare tags\n\n", shorten(err.Error(), 80))
+	default:
+		fmt.Printf("Reference digest: %s (from %s)\n\n", reference, source)
+	}
+
+	done := 0
+	results := Inspect(c.Context, imageName, registries, timeout, func(Inspection) {
+		done++
+		common.Progress("Inspected", done, len(registries))
+	})
+	common.ClearProgress()
+
+	table := common.NewTable("Registry", "Tag", "Digest", "Platforms", "Proxies", "Error")
+	for _, result := range results {
+		tag := result.Tag(reference)
+		color := common.Red
+		switch tag {
+		case TAG_CURRENT:
+			color = common.Green
+		case TAG_STALE, TAG_UNVERIFIED:
+			color = common.Yellow
+		}
+		errText := ""
+		if result.Err != nil {
+			errText = shorten(result.Err.Error(), 80)
+		}
+		table.AddRow(common.Plain(result.Registry), common.Colored(color, tag), common.Plain(shortDigest(result.Digest)),
+			common.Plain(orDash(result.Platforms)), common.Plain(orDash(result.Namespaces)), common.Plain(errText))
+	}
+	table.Print()
+	fmt.Printf("\n%s\n", InspectSummary(results, reference))
+	return common.Interrupted(c.Context)
+}
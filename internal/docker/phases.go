@@ -0,0 +1,307 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+)
+
+// manifestAccept lists the manifest media types fastdocker understands.
+var manifestAccept = []types.MediaType{
+	types.OCIImageIndex,
+	types.DockerManifestList,
+	types.OCIManifestSchema1,
+	types.DockerManifestSchema2,
+}
+
+// maxManifestSize bounds manifests and configs, which are read whole to
+// verify them.
+const maxManifestSize = 4 << 20
+
+// DefaultPlatform is the platform pulled and measured when none is given:
+// linux on the architecture of this machine, like docker pull.
+func DefaultPlatform() v1.Platform {
+	return v1.Platform{OS: "linux", Architecture: runtime.GOARCH}
+}
+
+// Phases are the timings of pulling an image from one registry, measured in
+// the same steps for every registry so they can be compared.
+type Phases struct {
+	// Auth is the time to ping the registry and get a pull token.
+	Auth time.Duration
+	// Manifest is the time to get the image manifest, including the
+	// platform manifest when the image is an index.
+	Manifest time.Duration
+	// Platforms the registry serves the image for.
+	Platforms []string
+	// Blob is the digest of the largest layer, which is downloaded to
+	// measure throughput.
+	Blob     v1.Hash
+	BlobSize int64
+	// BlobBytes were received in BlobTime.
+	BlobBytes int64
+	BlobTime  time.Duration
+	// BlobVerified is true when the whole blob was received and matched its
+	// digest. Blobs cut short by the timeout or --max-bytes are not verified.
+	BlobVerified bool
+}
+
+// BytesPerSecond returns the throughput of the blob download.
+func (p Phases) BytesPerSecond() int64 {
+	if p.BlobTime <= 0 {
+		return 0
+	}
+	return int64(float64(p.BlobBytes) / p.BlobTime.Seconds())
+}
+
+// MeasureRegistry pulls imageName for platform from registry in three phases:
+// auth token, manifest and the largest layer. The layer download stops when ctx is done
+// or opts.MaxBytes were received, and is discarded unless opts.KeepDir is set.
+// Manifests and blobs are verified against their digests, and an error
+// wrapping ErrDigestMismatch is returned when the registry tampered with them.
+func MeasureRegistry(ctx context.Context, imageName string, platform v1.Platform, registry Registry, opts common.DownloadOptions) (Phases, error) {
+	return measureRegistry(ctx, imageName, platform, registry, nil, opts)
+}
+
+// measureRegistry is MeasureRegistry downloading blob instead of the largest
+// layer of the manifest the registry serves, unless blob is nil.
+func measureRegistry(ctx context.Context, imageName string, platform v1.Platform, registry Registry, blob *v1.Descriptor, opts common.DownloadOptions) (Phases, error) {
+	var phases Phases
+	ref, err := registry.Reference(imageName)
+	if err != nil {
+		return phases, err
+	}
+	repo := ref.Context()
+
+	started := time.Now()
+	client, err := connect(ctx, repo, registry)
+	if err != nil {
+		return phases, fmt.Errorf("auth: %w", err)
+	}
+	phases.Auth = time.Since(started)
+
+	started = time.Now()
+	manifest, platforms, err := fetchManifest(ctx, client, repo, ref.Identifier(), platform)
+	phases.Platforms = platforms
+	if err != nil {
+		return phases, fmt.Errorf("manifest: %w", err)
+	}
+	phases.Manifest = time.Since(started)
+
+	if blob == nil {
+		if len(manifest.Layers) == 0 {
+			return phases, errors.New("manifest: image has no layers")
+		}
+		blob = &manifest.Layers[0]
+		for i, layer := range manifest.Layers[1:] {
+			if layer.Size > blob.Size {
+				blob = &manifest.Layers[i+1]
+			}
+		}
+	}
+	phases.Blob, phases.BlobSize = blob.Digest, blob.Size
+
+	started = time.Now()
+	phases.BlobBytes, phases.BlobVerified, err = fetchBlob(ctx, client, repo, *blob, registry.Host, opts)
+	phases.BlobTime = time.Since(started)
+	if err != nil && (ctx.Err() == nil || errors.Is(err, ErrDigestMismatch)) {
+		return phases, fmt.Errorf("blob: %w", err)
+	}
+	return phases, nil
+}
+
+// connect pings the registry of repo and returns a client authorized to pull
+// from repo with the options of registry.
+func connect(ctx context.Context, repo name.Repository, registry Registry) (*http.Client, error) {
+	auth, err := registry.Authenticator(repo)
+	if err != nil {
+		return nil, err
+	}
+	base, err := registry.Transport()
+	if err != nil {
+		return nil, err
+	}
+	rt, err := transport.NewWithContext(ctx, repo.Registry, auth, base, []string{repo.Scope(transport.PullScope)})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: rt}, nil
+}
+
+// fetchManifest returns the image manifest of identifier (a tag or digest)
+// for platform and the platforms the image is available for. An index is
+// resolved to the manifest of platform, a single manifest must be built for
+// platform unless its config does not say. Manifests requested by digest
+// and the config are verified.
+func fetchManifest(ctx context.Context, client *http.Client, repo name.Repository, identifier string, platform v1.Platform) (*v1.Manifest, []string, error) {
+	body, mediaType, err := get(ctx, client, repo, "manifests/"+identifier)
+	if err != nil {
+		return nil, nil, err
+	}
+	if isDigest(identifier) {
+		expected, err := v1.NewHash(identifier)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := verifyDigest("manifest", body, expected); err != nil {
+			return nil, nil, err
+		}
+	}
+	if mediaType.IsIndex() {
+		index, err := v1.ParseIndexManifest(bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		platforms := indexPlatforms(index)
+		for _, desc := range index.Manifests {
+			if desc.Platform != nil && desc.Platform.Satisfies(platform) {
+				body, _, err := get(ctx, client, repo, "manifests/"+desc.Digest.String())
+				if err != nil {
+					return nil, platforms, err
+				}
+				if err := verifyDigest("manifest", body, desc.Digest); err != nil {
+					return nil, platforms, err
+				}
+				manifest, err := v1.ParseManifest(bytes.NewReader(body))
+				return manifest, platforms, err
+			}
+		}
+		return nil, platforms, fmt.Errorf("no manifest for platform %s, the image is available for %s", platform, orDash(platforms))
+	}
+
+	manifest, err := v1.ParseManifest(bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	configured, err := configPlatform(ctx, client, repo, manifest)
+	if err != nil {
+		return nil, nil, err
+	}
+	if configured == nil {
+		return manifest, nil, nil
+	}
+	platforms := []string{configured.String()}
+	if !configured.Satisfies(platform) {
+		return nil, platforms, fmt.Errorf("no manifest for platform %s, the image is only available for %s", platform, configured)
+	}
+	return manifest, platforms, nil
+}
+
+// indexPlatforms lists the platforms of the images in index.
+func indexPlatforms(index *v1.IndexManifest) []string {
+	var platforms []string
+	for _, desc := range index.Manifests {
+		// Attestations are listed with the platform unknown/unknown.
+		if desc.Platform != nil && desc.Platform.OS != "unknown" {
+			platforms = append(platforms, desc.Platform.String())
+		}
+	}
+	return platforms
+}
+
+// configPlatform reads the platform from the config of manifest, which is nil
+// when the config does not name one.
+func configPlatform(ctx context.Context, client *http.Client, repo name.Repository, manifest *v1.Manifest) (*v1.Platform, error) {
+	body, _, err := get(ctx, client, repo, "blobs/"+manifest.Config.Digest.String())
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyDigest("config", body, manifest.Config.Digest); err != nil {
+		return nil, err
+	}
+	config, err := v1.ParseConfigFile(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	return config.Platform(), nil
+}
+
+func get(ctx context.Context, client *http.Client, repo name.Repository, path string) ([]byte, types.MediaType, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, registryURL(repo, path), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, mediaType := range manifestAccept {
+		req.Header.Add("Accept", string(mediaType))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if err := transport.CheckError(resp, http.StatusOK); err != nil {
+		return nil, "", err
+	}
+	// One byte more is read, so larger documents fail instead of being cut
+	// off and then failing verification.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(body) > maxManifestSize {
+		return nil, "", fmt.Errorf("%s is larger than %s", path, common.FormatDataSize(maxManifestSize))
+	}
+	return body, types.MediaType(resp.Header.Get("Content-Type")), nil
+}
+
+// fetchBlob downloads the blob of layer and reports whether it was received
+// completely and verified.
+func fetchBlob(ctx context.Context, client *http.Client, repo name.Repository, layer v1.Descriptor, registry string, opts common.DownloadOptions) (int64, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, registryURL(repo, "blobs/"+layer.Digest.String()), nil)
+	if err != nil {
+		return 0, false, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+	if err := transport.CheckError(resp, http.StatusOK); err != nil {
+		return 0, false, err
+	}
+
+	var dst io.Writer = io.Discard
+	if opts.KeepDir != "" {
+		file, err := opts.KeepFile(registry, layer.Digest.Hex)
+		if err != nil {
+			return 0, false, err
+		}
+		defer file.Close()
+		dst = file
+	}
+	// One byte more than the layer is read, so longer blobs are noticed.
+	limit := layer.Size + 1
+	truncated := opts.MaxBytes > 0 && opts.MaxBytes < layer.Size
+	if truncated {
+		limit = opts.MaxBytes
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(dst, hash), io.LimitReader(resp.Body, limit))
+	if err != nil || ctx.Err() != nil || (truncated && n == limit) {
+		return n, false, err
+	}
+	if n != layer.Size {
+		return n, false, fmt.Errorf("%w: blob %s has %d bytes instead of %d", ErrDigestMismatch, layer.Digest, n, layer.Size)
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); layer.Digest.Algorithm != "sha256" || got != layer.Digest.Hex {
+		return n, false, fmt.Errorf("%w: blob %s has digest sha256:%s", ErrDigestMismatch, layer.Digest, got)
+	}
+	return n, true, nil
+}
+
+func registryURL(repo name.Repository, path string) string {
+	return fmt.Sprintf("%s://%s/v2/%s/%s", repo.Registry.Scheme(), repo.RegistryStr(), repo.RepositoryStr(), path)
+}
@@ -0,0 +1,381 @@
+package docker
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/docker-credential-helpers/client"
+	"github.com/docker/docker-credential-helpers/credentials"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+)
+
+// Kinds of registry authentication, set with auth= in dockerRegistry.conf.
+const (
+	// AUTH_DEFAULT uses the credentials of the local docker login.
+	AUTH_DEFAULT       = "default"
+	AUTH_ANONYMOUS     = "anonymous"
+	AUTH_BASIC         = "basic"
+	AUTH_BEARER        = "bearer"
+	AUTH_DOCKER_CONFIG = "docker-config"
+	AUTH_HELPER        = "helper"
+)
+
+// Auth tells how to authenticate to a registry. Secrets are never stored in
+// the config file, only the names of the environment variables holding them.
+type Auth struct {
+	Kind        string
+	UsernameEnv string
+	PasswordEnv string
+	TokenEnv    string
+	// DockerConfig is the path of a docker config.json to read the
+	// registry's credentials from.
+	DockerConfig string
+	// Helper is the name of a docker credential helper, e.g. "pass" for
+	// docker-credential-pass.
+	Helper string
+}
+
+// Registry is an entry of dockerRegistry.conf: a registry host followed by
+// its options, for example
+//
+//	mirror.example.com auth=basic username-env=MIRROR_USER password-env=MIRROR_PASSWORD
+//	docker.host:5000 plain-http
+//	harbor.example.com prefix=dockerhub map=ghcr.io:ghcr
+type Registry struct {
+	Host string
+	Auth Auth
+	// Insecure skips the verification of the registry's TLS certificate.
+	Insecure bool
+	// PlainHTTP talks to the registry over HTTP instead of HTTPS.
+	PlainHTTP bool
+	// CAFile is a PEM file with the CA certificates the registry's
+	// certificate is verified with, in addition to the system ones.
+	CAFile string
+	// Prefix is put before the repository of Docker Hub images, for mirrors
+	// serving Docker Hub under a project like harbor.example.com/dockerhub.
+	Prefix string
+	// NoLibrary drops library/ from official Docker Hub images, for mirrors
+	// serving ubuntu as mirror/ubuntu instead of mirror/library/ubuntu.
+	NoLibrary bool
+	// Namespaces maps other upstream registries, such as ghcr.io, to the
+	// path the mirror serves them under. Unmapped registries are served
+	// under their host name, e.g. mirror/ghcr.io/owner/image.
+	Namespaces map[string]string
+}
+
+// flagOptions are the options of dockerRegistry.conf that take no value.
+var flagOptions = map[string]bool{"insecure": true, "plain-http": true, "no-library": true}
+
+// ParseRegistries parses the whitespace separated fields of dockerRegistry.conf.
+// Fields of the form key=value and the flags in flagOptions are options of
+// the registry before them.
+func ParseRegistries(fields []string) ([]Registry, error) {
+	var registries []Registry
+	for _, field := range fields {
+		key, value, isOption := strings.Cut(field, "=")
+		if flagOptions[field] {
+			isOption = true
+		}
+		if !isOption {
+			registries = append(registries, Registry{Host: field})
+			continue
+		}
+		if len(registries) == 0 {
+			return nil, fmt.Errorf("option %q before the first registry", field)
+		}
+		if err := registries[len(registries)-1].setOption(key, value); err != nil {
+			return nil, err
+		}
+	}
+	for i := range registries {
+		if err := registries[i].Auth.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", registries[i].Host, err)
+		}
+	}
+	return registries, nil
+}
+
+func (r *Registry) setOption(key, value string) error {
+	if flagOptions[key] {
+		if value != "" {
+			return fmt.Errorf("%s: option %s takes no value", r.Host, key)
+		}
+	} else if value == "" {
+		return fmt.Errorf("%s: option %s needs a value", r.Host, key)
+	}
+	switch key {
+	case "insecure":
+		r.Insecure = true
+	case "plain-http":
+		r.PlainHTTP = true
+	case "ca-file":
+		r.CAFile = value
+	case "prefix":
+		r.Prefix = strings.Trim(value, "/")
+	case "no-library":
+		r.NoLibrary = true
+	case "map":
+		upstream, path, ok := strings.Cut(value, ":")
+		path = strings.Trim(path, "/")
+		if !ok || upstream == "" || path == "" {
+			return fmt.Errorf("%s: map=%s, expected map=<registry>:<path>", r.Host, value)
+		}
+		registry, err := name.NewRegistry(upstream)
+		if err != nil {
+			return fmt.Errorf("%s: map=%s: %v", r.Host, value, err)
+		}
+		if r.Namespaces == nil {
+			r.Namespaces = make(map[string]string)
+		}
+		r.Namespaces[registry.RegistryStr()] = path
+	case "auth":
+		r.Auth.Kind = value
+	case "username-env":
+		r.Auth.UsernameEnv = value
+	case "password-env":
+		r.Auth.PasswordEnv = value
+	case "token-env":
+		r.Auth.TokenEnv = value
+	case "docker-config":
+		r.Auth.DockerConfig = value
+	case "helper":
+		r.Auth.Helper = value
+	default:
+		return fmt.Errorf("%s: unknown option %q", r.Host, key)
+	}
+	return nil
+}
+
+// validate infers the kind of authentication from the options when auth= is
+// missing and checks that the options it needs are set.
+func (a *Auth) validate() error {
+	if a.Kind == "" {
+		switch {
+		case a.DockerConfig != "":
+			a.Kind = AUTH_DOCKER_CONFIG
+		case a.Helper != "":
+			a.Kind = AUTH_HELPER
+		case a.TokenEnv != "":
+			a.Kind = AUTH_BEARER
+		case a.UsernameEnv != "" || a.PasswordEnv != "":
+			a.Kind = AUTH_BASIC
+		default:
+			a.Kind = AUTH_DEFAULT
+		}
+	}
+	switch a.Kind {
+	case AUTH_DEFAULT, AUTH_ANONYMOUS:
+	case AUTH_BASIC:
+		if a.UsernameEnv == "" || a.PasswordEnv == "" {
+			return fmt.Errorf("auth=%s needs username-env and password-env", a.Kind)
+		}
+	case AUTH_BEARER:
+		if a.TokenEnv == "" {
+			return fmt.Errorf("auth=%s needs token-env", a.Kind)
+		}
+	case AUTH_DOCKER_CONFIG:
+		if a.DockerConfig == "" {
+			return fmt.Errorf("auth=%s needs docker-config", a.Kind)
+		}
+	case AUTH_HELPER:
+		if a.Helper == "" {
+			return fmt.Errorf("auth=%s needs helper", a.Kind)
+		}
+	default:
+		return fmt.Errorf("unknown auth %q, expected %s, %s, %s, %s, %s or %s", a.Kind,
+			AUTH_DEFAULT, AUTH_ANONYMOUS, AUTH_BASIC, AUTH_BEARER, AUTH_DOCKER_CONFIG, AUTH_HELPER)
+	}
+	return nil
+}
+
+// Reference returns the reference of imageName on the registry. imageName is
+// normalized first, so ubuntu is Docker Hub's library/ubuntu, and then mapped
+// to the path the registry serves it under (see MirrorPath). A registry
+// without host returns imageName on the registry it names or Docker Hub.
+func (r Registry) Reference(imageName string) (name.Reference, error) {
+	var opts []name.Option
+	if r.PlainHTTP {
+		opts = append(opts, name.Insecure)
+	}
+	upstream, err := name.ParseReference(imageName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image reference: %v", err)
+	}
+	if r.Host == "" {
+		return name.ParseReference(upstream.Name(), opts...)
+	}
+
+	separator := ":"
+	if _, ok := upstream.(name.Digest); ok {
+		separator = "@"
+	}
+	ref, err := name.ParseReference(r.Host+"/"+r.MirrorPath(upstream.Context())+separator+upstream.Identifier(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map %s to %s: %v", imageName, r.Host, err)
+	}
+	return ref, nil
+}
+
+// MirrorPath returns the repository path the registry serves the upstream
+// repository under: Docker Hub repositories under prefix, with library/ for
+// official images unless no-library is set, and other registries under the
+// path they are mapped to or their host name.
+func (r Registry) MirrorPath(repo name.Repository) string {
+	host, path := repo.RegistryStr(), repo.RepositoryStr()
+	switch {
+	case host == r.Host:
+		return path
+	case host == name.DefaultRegistry:
+		if r.NoLibrary {
+			path = strings.TrimPrefix(path, "library/")
+		}
+		if r.Prefix != "" {
+			path = r.Prefix + "/" + path
+		}
+		return path
+	case r.Namespaces[host] != "":
+		return r.Namespaces[host] + "/" + path
+	}
+	return host + "/" + path
+}
+
+// Transport returns the HTTP transport to talk to the registry with,
+// honoring insecure and ca-file.
+func (r Registry) Transport() (http.RoundTripper, error) {
+	if !r.Insecure && r.CAFile == "" {
+		return http.DefaultTransport, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: r.Insecure}
+	if r.CAFile != "" {
+		pem, err := os.ReadFile(r.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("ca-file: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca-file: no certificates found in %s", r.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// Client returns an HTTP client authenticated to pull repo, a repository on
+// the registry, through the registry's transport options.
+func (r Registry) Client(ctx context.Context, repo name.Repository) (*http.Client, error) {
+	return connect(ctx, repo, r)
+}
+
+// Authenticator returns the credentials to pull repo from the registry.
+func (r Registry) Authenticator(repo name.Repository) (authn.Authenticator, error) {
+	switch r.Auth.Kind {
+	case AUTH_ANONYMOUS:
+		return authn.Anonymous, nil
+	case AUTH_BASIC:
+		username, err := env(r.Auth.UsernameEnv)
+		if err != nil {
+			return nil, err
+		}
+		password, err := env(r.Auth.PasswordEnv)
+		if err != nil {
+			return nil, err
+		}
+		return authn.FromConfig(authn.AuthConfig{Username: username, Password: password}), nil
+	case AUTH_BEARER:
+		token, err := env(r.Auth.TokenEnv)
+		if err != nil {
+			return nil, err
+		}
+		return authn.FromConfig(authn.AuthConfig{RegistryToken: token}), nil
+	case AUTH_DOCKER_CONFIG:
+		file, err := os.Open(r.Auth.DockerConfig)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		configFile, err := config.LoadFromReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", r.Auth.DockerConfig, err)
+		}
+		cfg, err := configFile.GetAuthConfig(repo.RegistryStr())
+		if err != nil {
+			return nil, err
+		}
+		return authn.FromConfig(authn.AuthConfig{
+			Username:      cfg.Username,
+			Password:      cfg.Password,
+			Auth:          cfg.Auth,
+			IdentityToken: cfg.IdentityToken,
+			RegistryToken: cfg.RegistryToken,
+		}), nil
+	case AUTH_HELPER:
+		creds, err := client.Get(credentialHelper(r.Auth.Helper), repo.RegistryStr())
+		if credentials.IsErrCredentialsNotFound(err) {
+			return authn.Anonymous, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("docker-credential-%s: %v", r.Auth.Helper, err)
+		}
+		if creds.Username == "<token>" {
+			return authn.FromConfig(authn.AuthConfig{IdentityToken: creds.Secret}), nil
+		}
+		return authn.FromConfig(authn.AuthConfig{Username: creds.Username, Password: creds.Secret}), nil
+	}
+	return authn.DefaultKeychain.Resolve(repo)
+}
+
+func env(variable string) (string, error) {
+	value := os.Getenv(variable)
+	if value == "" {
+		return "", fmt.Errorf("environment variable %s is not set", variable)
+	}
+	return value, nil
+}
+
+// Hosts returns the host of every registry.
+func Hosts(registries []Registry) []string {
+	hosts := make([]string, len(registries))
+	for i, registry := range registries {
+		hosts[i] = registry.Host
+	}
+	return hosts
+}
+
+// Lookup returns the configured registry with host, or a registry with
+// default options when host is not configured.
+func Lookup(registries []Registry, host string) Registry {
+	for _, registry := range registries {
+		if registry.Host == host {
+			return registry
+		}
+	}
+	return Registry{Host: host, Auth: Auth{Kind: AUTH_DEFAULT}}
+}
+
+// ReadRegistries reads the registries and their options from
+// dockerRegistry.conf, downloading the default list when it is missing.
+func ReadRegistries() ([]Registry, error) {
+	fields, err := common.ReadOrDownloadConfig(common.DOCKER_CONFIG_FILE, common.DOCKER_CONFIG_URL)
+	if err != nil {
+		return nil, err
+	}
+	registries, err := ParseRegistries(fields)
+	if err != nil {
+		path, _ := common.ConfigPath(common.DOCKER_CONFIG_FILE)
+		return nil, &common.ConfigError{Op: "parse", Path: path, Err: err}
+	}
+	return registries, nil
+}
@@ -0,0 +1,217 @@
+package docker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRegistries(t *testing.T) {
+	registries, err := ParseRegistries(strings.Fields(`docker.arvancloud.ir focker.ir
+private.example.com auth=basic username-env=USER password-env=PASS
+token.example.com token-env=TOKEN
+open.example.com auth=anonymous`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"docker.arvancloud.ir", "focker.ir", "private.example.com", "token.example.com", "open.example.com"}, Hosts(registries))
+	assert.Equal(t, AUTH_DEFAULT, registries[0].Auth.Kind)
+	assert.Equal(t, Auth{Kind: AUTH_BASIC, UsernameEnv: "USER", PasswordEnv: "PASS"}, registries[2].Auth)
+	assert.Equal(t, Auth{Kind: AUTH_BEARER, TokenEnv: "TOKEN"}, registries[3].Auth)
+	assert.Equal(t, AUTH_ANONYMOUS, registries[4].Auth.Kind)
+
+	assert.Equal(t, registries[2], Lookup(registries, "private.example.com"))
+	assert.Equal(t, Registry{Host: "other.example.com", Auth: Auth{Kind: AUTH_DEFAULT}}, Lookup(registries, "other.example.com"))
+
+	for _, config := range []string{
+		"auth=basic mirror.example.com",
+		"mirror.example.com auth=basic username-env=USER",
+		"mirror.example.com auth=kerberos",
+		"mirror.example.com colour=blue",
+		"mirror.example.com helper=",
+	} {
+		_, err := ParseRegistries(strings.Fields(config))
+		assert.Error(t, err, config)
+	}
+}
+
+func authorization(t *testing.T, registry Registry) string {
+	t.Helper()
+	repo, err := name.NewRepository(registry.Host + "/library/test")
+	assert.NoError(t, err)
+	auth, err := registry.Authenticator(repo)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	header, err := authn.Authorization(context.Background(), auth)
+	assert.NoError(t, err)
+	if header.RegistryToken != "" {
+		return "Bearer " + header.RegistryToken
+	}
+	if header.Username != "" {
+		return "Basic " + header.Username + ":" + header.Password
+	}
+	return ""
+}
+
+func TestAuthenticator(t *testing.T) {
+	t.Setenv("MIRROR_USER", "alice")
+	t.Setenv("MIRROR_PASSWORD", "secret")
+	t.Setenv("MIRROR_TOKEN", "t0ken")
+
+	assert.Equal(t, "", authorization(t, Registry{Host: "mirror.example.com", Auth: Auth{Kind: AUTH_ANONYMOUS}}))
+	assert.Equal(t, "Basic alice:secret", authorization(t, Registry{Host: "mirror.example.com",
+		Auth: Auth{Kind: AUTH_BASIC, UsernameEnv: "MIRROR_USER", PasswordEnv: "MIRROR_PASSWORD"}}))
+	assert.Equal(t, "Bearer t0ken", authorization(t, Registry{Host: "mirror.example.com", Auth: Auth{Kind: AUTH_BEARER, TokenEnv: "MIRROR_TOKEN"}}))
+
+	repo, err := name.NewRepository("mirror.example.com/library/test")
+	assert.NoError(t, err)
+	_, err = Registry{Host: "mirror.example.com", Auth: Auth{Kind: AUTH_BEARER, TokenEnv: "MIRROR_UNSET"}}.Authenticator(repo)
+	assert.ErrorContains(t, err, "MIRROR_UNSET")
+
+	dir := t.TempDir()
+	dockerConfig := filepath.Join(dir, "config.json")
+	auth := base64.StdEncoding.EncodeToString([]byte("bob:hunter2"))
+	assert.NoError(t, os.WriteFile(dockerConfig, []byte(`{"auths":{"mirror.example.com":{"auth":"`+auth+`"}}}`), 0o600))
+	assert.Equal(t, "Basic bob:hunter2", authorization(t, Registry{Host: "mirror.example.com", Auth: Auth{Kind: AUTH_DOCKER_CONFIG, DockerConfig: dockerConfig}}))
+
+	helper := "#!/bin/sh\nread server\necho '{\"ServerURL\":\"'$server'\",\"Username\":\"carol\",\"Secret\":\"pw\"}'\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "docker-credential-test"), []byte(helper), 0o755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	assert.Equal(t, "Basic carol:pw", authorization(t, Registry{Host: "mirror.example.com", Auth: Auth{Kind: AUTH_HELPER, Helper: "test"}}))
+}
+
+func TestMeasureRegistryBasicAuth(t *testing.T) {
+	handler := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "alice" || password != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	img, err := random.Image(1024, 1)
+	assert.NoError(t, err)
+	ref, err := name.ParseReference(host + "/library/private:latest")
+	assert.NoError(t, err)
+	assert.NoError(t, remote.Write(ref, img, remote.WithAuth(&authn.Basic{Username: "alice", Password: "secret"})))
+
+	t.Setenv("MIRROR_USER", "alice")
+	t.Setenv("MIRROR_PASSWORD", "secret")
+	private := Registry{Host: host, Auth: Auth{Kind: AUTH_BASIC, UsernameEnv: "MIRROR_USER", PasswordEnv: "MIRROR_PASSWORD"}}
+	_, err = MeasureRegistry(context.Background(), "library/private:latest", amd64, private, common.DownloadOptions{})
+	assert.NoError(t, err)
+
+	_, err = MeasureRegistry(context.Background(), "library/private:latest", amd64, Registry{Host: host, Auth: Auth{Kind: AUTH_ANONYMOUS}}, common.DownloadOptions{})
+	assert.ErrorContains(t, err, "401 Unauthorized")
+}
+
+func TestParseRegistriesTransportOptions(t *testing.T) {
+	registries, err := ParseRegistries(strings.Fields("docker.host:5000 plain-http mirror.example.com insecure ca-file=/etc/ssl/mirror.pem"))
+	assert.NoError(t, err)
+	assert.Equal(t, []Registry{
+		{Host: "docker.host:5000", Auth: Auth{Kind: AUTH_DEFAULT}, PlainHTTP: true},
+		{Host: "mirror.example.com", Auth: Auth{Kind: AUTH_DEFAULT}, Insecure: true, CAFile: "/etc/ssl/mirror.pem"},
+	}, registries)
+
+	ref, err := registries[0].Reference("alpine:3.20")
+	assert.NoError(t, err)
+	assert.Equal(t, "http", ref.Context().Registry.Scheme())
+	ref, err = registries[1].Reference("alpine:3.20")
+	assert.NoError(t, err)
+	assert.Equal(t, "https", ref.Context().Registry.Scheme())
+	ref, err = Registry{}.Reference("ghcr.io/x/y:1")
+	assert.NoError(t, err)
+	assert.Equal(t, "ghcr.io/x/y:1", ref.String())
+
+	for _, config := range []string{"insecure docker.host:5000", "docker.host:5000 plain-http=yes", "docker.host:5000 ca-file="} {
+		_, err := ParseRegistries(strings.Fields(config))
+		assert.Error(t, err, config)
+	}
+}
+
+func TestRegistryTransport(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	get := func(registry Registry) error {
+		rt, err := registry.Transport()
+		if err != nil {
+			return err
+		}
+		resp, err := (&http.Client{Transport: rt}).Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	assert.ErrorContains(t, get(Registry{}), "certificate")
+	assert.NoError(t, get(Registry{Insecure: true}))
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	assert.NoError(t, os.WriteFile(caFile, certificate, 0o644))
+	assert.NoError(t, get(Registry{CAFile: caFile}))
+
+	assert.ErrorContains(t, get(Registry{CAFile: filepath.Join(t.TempDir(), "missing.pem")}), "ca-file")
+}
+
+func TestRegistryReference(t *testing.T) {
+	registries, err := ParseRegistries(strings.Fields(`mirror.example.com
+short.example.com no-library
+harbor.example.com prefix=/dockerhub/ map=ghcr.io:ghcr map=quay.io:proxies/quay`))
+	assert.NoError(t, err)
+	mirror, short, harbor := registries[0], registries[1], registries[2]
+	assert.Equal(t, map[string]string{"ghcr.io": "ghcr", "quay.io": "proxies/quay"}, harbor.Namespaces)
+
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		registry Registry
+		image    string
+		expected string
+	}{
+		{mirror, "ubuntu", "mirror.example.com/library/ubuntu:latest"},
+		{mirror, "library/ubuntu:24.04", "mirror.example.com/library/ubuntu:24.04"},
+		{mirror, "docker.io/bitnami/redis:7", "mirror.example.com/bitnami/redis:7"},
+		{mirror, "ghcr.io/owner/image:1", "mirror.example.com/ghcr.io/owner/image:1"},
+		{mirror, "mirror.example.com/team/app:2", "mirror.example.com/team/app:2"},
+		{mirror, "alpine@" + digest, "mirror.example.com/library/alpine@" + digest},
+		{short, "ubuntu", "short.example.com/ubuntu:latest"},
+		{short, "bitnami/redis", "short.example.com/bitnami/redis:latest"},
+		{harbor, "ubuntu:24.04", "harbor.example.com/dockerhub/library/ubuntu:24.04"},
+		{harbor, "ghcr.io/owner/image:1", "harbor.example.com/ghcr/owner/image:1"},
+		{harbor, "quay.io/prometheus/busybox", "harbor.example.com/proxies/quay/prometheus/busybox:latest"},
+		{harbor, "gcr.io/distroless/static", "harbor.example.com/gcr.io/distroless/static:latest"},
+		{Registry{}, "ubuntu", "index.docker.io/library/ubuntu:latest"},
+	}
+	for _, tt := range tests {
+		ref, err := tt.registry.Reference(tt.image)
+		if assert.NoError(t, err, tt.image) {
+			assert.Equal(t, tt.expected, ref.Name(), "%s on %s", tt.image, tt.registry.Host)
+		}
+	}
+
+	for _, config := range []string{"harbor.example.com map=ghcr.io", "harbor.example.com map=:ghcr", "harbor.example.com map=ghcr.io:/"} {
+		_, err := ParseRegistries(strings.Fields(config))
+		assert.Error(t, err, config)
+	}
+}
@@ -0,0 +1,335 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// ImageRef is an image referenced by Docker Compose files or Kubernetes
+// manifests.
+type ImageRef struct {
+	Image string
+	// Sources are the places the image is referenced, as file:line.
+	Sources []string
+	// Err is set when Image is not a valid image reference, e.g. because it
+	// uses a variable that is not set.
+	Err error
+}
+
+// composeVariable matches $VAR, ${VAR}, ${VAR:-default} and ${VAR-default}.
+var composeVariable = regexp.MustCompile(`\$(?:([A-Za-z_][A-Za-z0-9_]*)|\{([A-Za-z_][A-Za-z0-9_]*)(?:(:?-)([^}]*))?\})`)
+
+// expandVariables substitutes environment variables in image the way Docker
+// Compose does.
+func expandVariables(image string) string {
+	return composeVariable.ReplaceAllStringFunc(image, func(match string) string {
+		groups := composeVariable.FindStringSubmatch(match)
+		if groups[1] != "" {
+			return os.Getenv(groups[1])
+		}
+		value, set := os.LookupEnv(groups[2])
+		switch {
+		case groups[3] == ":-" && value == "":
+			return groups[4]
+		case groups[3] == "-" && !set:
+			return groups[4]
+		}
+		return value
+	})
+}
+
+// FindImages returns the images referenced by the YAML file at path, or by
+// the .yml and .yaml files below it when path is a directory, in order of
+// first reference. Every scalar "image" field counts, which covers the
+// services of Docker Compose files and the containers of Kubernetes
+// workloads. Files in a directory that are not valid YAML, like Helm
+// templates, are skipped and returned in skipped.
+func FindImages(path string) (images []ImageRef, skipped []error, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", common.ErrInvalidInput, err)
+	}
+	files := []string{path}
+	if info.IsDir() {
+		files = nil
+		err = filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				if file != path && strings.HasPrefix(entry.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if ext := filepath.Ext(file); ext == ".yml" || ext == ".yaml" {
+				files = append(files, file)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	index := make(map[string]int)
+	for _, file := range files {
+		found, err := imagesInFile(file)
+		if err != nil {
+			if !info.IsDir() {
+				return nil, nil, fmt.Errorf("%w: %s: %v", common.ErrInvalidInput, file, err)
+			}
+			skipped = append(skipped, fmt.Errorf("%s: %v", file, err))
+			continue
+		}
+		for _, ref := range found {
+			i, ok := index[ref.Image]
+			if !ok {
+				index[ref.Image] = len(images)
+				images = append(images, ref)
+				continue
+			}
+			images[i].Sources = append(images[i].Sources, ref.Sources...)
+		}
+	}
+	for i := range images {
+		if !DockerImageValidator(images[i].Image) {
+			images[i].Err = fmt.Errorf("invalid image reference %q", images[i].Image)
+		} else if _, err := name.ParseReference(images[i].Image); err != nil {
+			images[i].Err = err
+		}
+	}
+	return images, skipped, nil
+}
+
+// imagesInFile returns the images referenced in every YAML document of file.
+func imagesInFile(file string) ([]ImageRef, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var images []ImageRef
+	var walk func(node *yaml.Node)
+	walk = func(node *yaml.Node) {
+		if node.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key, value := node.Content[i], node.Content[i+1]
+				if key.Value == "image" && value.Kind == yaml.ScalarNode && value.Value != "" {
+					images = append(images, ImageRef{
+						Image:   expandVariables(value.Value),
+						Sources: []string{fmt.Sprintf("%s:%d", file, value.Line)},
+					})
+					continue
+				}
+				walk(value)
+			}
+			return
+		}
+		for _, child := range node.Content {
+			walk(child)
+		}
+	}
+
+	decoder := yaml.NewDecoder(f)
+	for {
+		var document yaml.Node
+		if err := decoder.Decode(&document); errors.Is(err, io.EOF) {
+			return images, nil
+		} else if err != nil {
+			return nil, err
+		}
+		walk(&document)
+	}
+}
+
+// ImageScan is how every registry serves a scanned image.
+type ImageScan struct {
+	ImageRef
+	// Digest is the manifest digest registries were verified against, zero
+	// when the trusted registry could not be reached.
+	Digest v1.Hash
+	// Results are sorted with SortResults.
+	Results []Result
+}
+
+// Available returns the registries that served the image.
+func (s ImageScan) Available() []string {
+	var hosts []string
+	for _, result := range s.Results {
+		if result.Err == nil && result.Bytes > 0 {
+			hosts = append(hosts, result.Registry)
+		}
+	}
+	return hosts
+}
+
+// Missing returns the registries that answered that they do not have the
+// image.
+func (s ImageScan) Missing() []string {
+	var hosts []string
+	for _, result := range s.Results {
+		if isNotFound(result.Err) {
+			hosts = append(hosts, result.Registry)
+		}
+	}
+	return hosts
+}
+
+// Failed returns the registries that could not be asked for the image or
+// served it with errors, marking untrusted ones.
+func (s ImageScan) Failed() []string {
+	var hosts []string
+	for _, result := range s.Results {
+		switch {
+		case result.Untrusted():
+			hosts = append(hosts, result.Registry+" (untrusted)")
+		case result.Err != nil && !isNotFound(result.Err):
+			hosts = append(hosts, result.Registry)
+		}
+	}
+	return hosts
+}
+
+// ScanWithDockerImage finds the images referenced by the Docker Compose
+// files or Kubernetes manifests in the first argument and benchmarks each of
+// them on every registry, reporting which registries serve it and which is
+// fastest.
+func ScanWithDockerImage(c *cli.Context) error {
+	timeout := time.Duration(c.Int("timeout")) * time.Second
+	path := c.Args().First()
+	platform, err := PlatformFlag(c)
+	if err != nil {
+		return err
+	}
+	maxBytes, err := common.ParseDataSize(c.String("max-bytes"))
+	if err != nil {
+		return fmt.Errorf("%w: --max-bytes: %v", common.ErrInvalidInput, err)
+	}
+	opts := common.DownloadOptions{MaxBytes: maxBytes}
+
+	images, skipped, err := FindImages(path)
+	if err != nil {
+		return err
+	}
+	for _, err := range skipped {
+		fmt.Printf("Skipped %s\n", shorten(err.Error(), 120))
+	}
+	if len(images) == 0 {
+		return fmt.Errorf("%w: no image references found in %s", common.ErrInvalidInput, path)
+	}
+
+	registries, err := ReadRegistries()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\nTimeout: %d seconds\n", c.Int("timeout"))
+	fmt.Printf("Platform: %s\n", platform)
+	fmt.Printf("Images: %d in %s\n\n", len(images), path)
+
+	var scans []ImageScan
+	done, total := 0, len(images)*len(registries)
+	for _, image := range images {
+		scan := ImageScan{ImageRef: image}
+		if image.Err == nil {
+			// Like fastdocker, every registry is asked for the same manifest
+			// by digest, resolved once per image.
+			pullName := image.Image
+			expected, _, err := ResolveDigest(c.Context, image.Image, "", c.String("reference"), registries, timeout)
+			if err == nil {
+				if pullName, err = Pin(image.Image, expected); err != nil {
+					return err
+				}
+				scan.Digest = expected
+			}
+			if common.Interrupted(c.Context) != nil {
+				break
+			}
+			started := time.Now()
+			scan.Results = Benchmark(c.Context, pullName, platform, registries, timeout, opts, func(Result) {
+				done++
+				common.Progress("Pulled", done, total)
+			})
+			if common.Interrupted(c.Context) != nil {
+				break
+			}
+			SortResults(scan.Results)
+			RecordHistory(c.Context, image.Image, started, timeout, scan.Results)
+		} else {
+			done += len(registries)
+		}
+		scans = append(scans, scan)
+	}
+	common.ClearProgress()
+	interrupted := common.Interrupted(c.Context)
+	if interrupted != nil {
+		fmt.Printf("\nInterrupted after %d of %d images, the report below is partial.\n\n", len(scans), len(images))
+	}
+
+	table := common.NewTable("Image", "Used In", "Mirrors", "Fastest", "Missing", "Failed")
+	var unavailable []string
+	for _, scan := range scans {
+		usedIn := shorten(strings.Join(scan.Sources, ", "), 40)
+		if scan.Err != nil {
+			unavailable = append(unavailable, scan.Image)
+			table.AddRow(common.Plain(scan.Image), common.Plain(usedIn), common.Colored(common.Red, "invalid"),
+				common.Plain("-"), common.Plain("-"), common.Plain(shorten(scan.Err.Error(), 60)))
+			continue
+		}
+		available := scan.Available()
+		mirrors := fmt.Sprintf("%d/%d", len(available), len(scan.Results))
+		fastest := common.Plain("-")
+		if best, size := Best(scan.Results); best != "" {
+			speed := common.FormatDataSize(size / int64(c.Int("timeout")))
+			fastest = common.Colored(common.Green, fmt.Sprintf("%s (%s/s)", best, speed))
+		} else {
+			unavailable = append(unavailable, scan.Image)
+		}
+		color := common.Green
+		if len(available) == 0 {
+			color = common.Red
+		}
+		table.AddRow(common.Plain(scan.Image), common.Plain(usedIn), common.Colored(color, mirrors), fastest,
+			common.Plain(shorten(orDash(scan.Missing()), 40)), common.Plain(shorten(orDash(scan.Failed()), 40)))
+	}
+	table.Print()
+
+	var unpinned []string
+	for _, scan := range scans {
+		if scan.Err == nil && scan.Digest == (v1.Hash{}) {
+			unpinned = append(unpinned, scan.Image)
+		}
+	}
+	if len(unpinned) > 0 {
+		fmt.Println(common.Colorize(common.Yellow, "Expected digest unavailable, only the layers are verified: "+strings.Join(unpinned, ", ")))
+	}
+
+	fmt.Printf("\n%d of %d images can be pulled through a registry\n", len(scans)-len(unavailable), len(scans))
+	if len(unavailable) > 0 {
+		sort.Strings(unavailable)
+		fmt.Println(common.Colorize(common.Red, "Unavailable: "+strings.Join(unavailable, ", ")))
+	}
+	if interrupted != nil {
+		return interrupted
+	}
+	if len(unavailable) > 0 && c.Bool("fail-if-none") {
+		return fmt.Errorf("%w: no registry could serve %s", common.ErrNoneWorked, strings.Join(unavailable, ", "))
+	}
+	return nil
+}
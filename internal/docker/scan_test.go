@@ -0,0 +1,106 @@
+package docker
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindImages(t *testing.T) {
+	dir := t.TempDir()
+	write := func(file, content string) string {
+		path := filepath.Join(dir, file)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		return path
+	}
+	compose := write("docker-compose.yml", `services:
+  web:
+    image: nginx:1.27
+  cache:
+    image: redis:${REDIS_TAG:-7}
+  app:
+    build: .
+  broken:
+    image: ${UNSET_REGISTRY}/app
+`)
+	write("k8s/deploy.yaml", `apiVersion: apps/v1
+kind: Deployment
+spec:
+  template:
+    spec:
+      initContainers:
+        - name: init
+          image: busybox:1.36
+      containers:
+        - name: web
+          image: nginx:1.27
+---
+apiVersion: batch/v1
+kind: CronJob
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+            - name: backup
+              image: ghcr.io/owner/backup@sha256:0123456789012345678901234567890123456789012345678901234567890123
+`)
+	write("chart/templates/deploy.yaml", "image: {{ .Values.image }}\n  - : [\n")
+	write(".git/config.yml", "image: ignored:1\n")
+	write("README.md", "image: ignored:2\n")
+
+	images, skipped, err := FindImages(dir)
+	assert.NoError(t, err)
+	assert.Len(t, skipped, 1)
+	assert.ErrorContains(t, skipped[0], filepath.Join("chart", "templates", "deploy.yaml"))
+
+	var names []string
+	for _, image := range images {
+		names = append(names, image.Image)
+	}
+	assert.Equal(t, []string{"nginx:1.27", "redis:7", "/app", "busybox:1.36",
+		"ghcr.io/owner/backup@sha256:0123456789012345678901234567890123456789012345678901234567890123"}, names)
+	assert.Equal(t, []string{compose + ":3", filepath.Join(dir, "k8s/deploy.yaml") + ":11"}, images[0].Sources)
+	assert.Error(t, images[2].Err)
+	for _, i := range []int{0, 1, 3, 4} {
+		assert.NoError(t, images[i].Err, images[i].Image)
+	}
+
+	t.Setenv("REDIS_TAG", "7.4")
+	images, _, err = FindImages(compose)
+	assert.NoError(t, err)
+	assert.Equal(t, "redis:7.4", images[1].Image)
+
+	_, _, err = FindImages(filepath.Join(dir, "chart/templates/deploy.yaml"))
+	assert.ErrorIs(t, err, common.ErrInvalidInput)
+	_, _, err = FindImages(filepath.Join(dir, "missing.yml"))
+	assert.ErrorIs(t, err, common.ErrInvalidInput)
+}
+
+func TestImageScan(t *testing.T) {
+	img, err := random.Image(64<<10, 3)
+	assert.NoError(t, err)
+	first, second := imageRegistry(t, img), imageRegistry(t, img)
+	registries := []Registry{{Host: first}, {Host: second}, {Host: "127.0.0.1:1"}}
+
+	results := Benchmark(context.Background(), "library/test:latest", amd64, registries, 5*time.Second, common.DownloadOptions{}, nil)
+	SortResults(results)
+	scan := ImageScan{ImageRef: ImageRef{Image: "library/test:latest"}, Results: results}
+	assert.Len(t, scan.Available(), 2)
+	assert.Equal(t, []string{"127.0.0.1:1"}, scan.Failed())
+	assert.Empty(t, scan.Missing())
+
+	results = Benchmark(context.Background(), "library/other:latest", amd64, registries, 5*time.Second, common.DownloadOptions{}, nil)
+	scan = ImageScan{ImageRef: ImageRef{Image: "library/other:latest"}, Results: results}
+	assert.Empty(t, scan.Available())
+	assert.ElementsMatch(t, []string{first, second}, scan.Missing())
+	assert.Equal(t, []string{"127.0.0.1:1"}, scan.Failed())
+}
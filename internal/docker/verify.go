@@ -0,0 +1,92 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+	"github.com/urfave/cli/v2"
+)
+
+// ErrDigestMismatch marks registries that served a manifest or blob whose
+// content does not match its digest. Such registries are untrusted.
+var ErrDigestMismatch = errors.New("digest mismatch")
+
+// verifyDigest returns an ErrDigestMismatch error when body does not hash to
+// expected.
+func verifyDigest(what string, body []byte, expected v1.Hash) error {
+	got, _, err := v1.SHA256(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if got != expected {
+		return fmt.Errorf("%w: %s %s has digest %s", ErrDigestMismatch, what, expected, got)
+	}
+	return nil
+}
+
+// isDigest reports whether identifier is a digest rather than a tag.
+func isDigest(identifier string) bool {
+	return strings.Contains(identifier, ":")
+}
+
+// Untrusted reports whether the registry served content that does not match
+// its digest.
+func (r Result) Untrusted() bool {
+	return errors.Is(r.Err, ErrDigestMismatch)
+}
+
+// Pin returns imageName pinned to digest, so every registry is asked for the
+// same manifest and its content can be verified.
+func Pin(imageName string, digest v1.Hash) (string, error) {
+	ref, err := name.ParseReference(imageName)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse image reference: %v", err)
+	}
+	return ref.Context().String() + "@" + digest.String(), nil
+}
+
+// ExpectedDigest returns the manifest digest registries must serve imageName
+// with and where it comes from, see ResolveDigest, taking digest and
+// reference from the --digest and --reference flags.
+func ExpectedDigest(c *cli.Context, imageName string, registries []Registry, timeout time.Duration) (v1.Hash, string, error) {
+	return ResolveDigest(c.Context, imageName, c.String("digest"), c.String("reference"), registries, timeout)
+}
+
+// ResolveDigest returns the manifest digest registries must serve imageName
+// with and where it comes from: the digest imageName is pinned to, digest,
+// or the trusted registry reference (the image's own registry when empty).
+// It fails when the trusted registry cannot be reached.
+func ResolveDigest(ctx context.Context, imageName, digest, reference string, registries []Registry, timeout time.Duration) (v1.Hash, string, error) {
+	ref, err := name.ParseReference(imageName)
+	if err != nil {
+		return v1.Hash{}, "", fmt.Errorf("%w: %v", common.ErrInvalidInput, err)
+	}
+	if pinned, ok := ref.(name.Digest); ok {
+		hash, err := v1.NewHash(pinned.DigestStr())
+		return hash, "image reference", err
+	}
+	if digest != "" {
+		hash, err := v1.NewHash(digest)
+		if err != nil {
+			return v1.Hash{}, "", fmt.Errorf("%w: --digest: %v", common.ErrInvalidInput, err)
+		}
+		return hash, "--digest", nil
+	}
+
+	trusted := Lookup(registries, reference)
+	source := trusted.Host
+	if source == "" {
+		source = ref.Context().RegistryStr()
+	}
+	refCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	hash, err := ReferenceDigest(refCtx, imageName, trusted)
+	return hash, source, err
+}
@@ -0,0 +1,109 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+	"github.com/stretchr/testify/assert"
+)
+
+// tamperingRegistry serves a random image as library/test:latest and passes
+// the body of every response whose path contains tamper through change, or
+// flips its first byte when change is nil.
+func tamperingRegistry(t *testing.T, tamper *string, change *func([]byte) []byte) (string, v1.Hash) {
+	t.Helper()
+	handler := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *tamper == "" || !strings.Contains(r.URL.Path, *tamper) || r.Method != http.MethodGet {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		body := recorder.Body.Bytes()
+		if *change != nil {
+			body = (*change)(body)
+		} else if len(body) > 0 {
+			body[0] ^= 0xff
+		}
+		for key, values := range recorder.Header() {
+			w.Header()[key] = values
+		}
+		w.Header().Del("Content-Length")
+		w.WriteHeader(recorder.Code)
+		io.Copy(w, bytes.NewReader(body))
+	}))
+	t.Cleanup(server.Close)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	img, err := random.Image(4096, 1)
+	assert.NoError(t, err)
+	ref, err := name.ParseReference(host + "/library/test:latest")
+	assert.NoError(t, err)
+	assert.NoError(t, remote.Write(ref, img))
+	digest, err := img.Digest()
+	assert.NoError(t, err)
+	return host, digest
+}
+
+func TestMeasureRegistryVerifiesDigests(t *testing.T) {
+	tamper := ""
+	var change func([]byte) []byte
+	host, digest := tamperingRegistry(t, &tamper, &change)
+	mirror := Registry{Host: host}
+	pinned, err := Pin("library/test:latest", digest)
+	assert.NoError(t, err)
+	assert.Equal(t, "index.docker.io/library/test@"+digest.String(), pinned)
+
+	phases, err := MeasureRegistry(context.Background(), pinned, amd64, mirror, common.DownloadOptions{})
+	assert.NoError(t, err)
+	assert.True(t, phases.BlobVerified)
+
+	phases, err = MeasureRegistry(context.Background(), pinned, amd64, mirror, common.DownloadOptions{MaxBytes: 1024})
+	assert.NoError(t, err)
+	assert.False(t, phases.BlobVerified, "a partial blob cannot be verified")
+
+	tamper = "/blobs/"
+	_, err = MeasureRegistry(context.Background(), pinned, amd64, mirror, common.DownloadOptions{})
+	assert.ErrorIs(t, err, ErrDigestMismatch)
+	assert.True(t, Result{Err: err}.Untrusted())
+
+	// Layers of the wrong size are not measured as if they were the layer.
+	tamper = "/blobs/" + phases.Blob.String()
+	change = func([]byte) []byte { return make([]byte, 1000) }
+	_, err = MeasureRegistry(context.Background(), pinned, amd64, mirror, common.DownloadOptions{})
+	assert.ErrorIs(t, err, ErrDigestMismatch)
+	change = func(body []byte) []byte { return append(body, 0) }
+	_, err = MeasureRegistry(context.Background(), pinned, amd64, mirror, common.DownloadOptions{})
+	assert.ErrorIs(t, err, ErrDigestMismatch)
+	change = nil
+
+	tamper = "/manifests/"
+	_, err = MeasureRegistry(context.Background(), pinned, amd64, mirror, common.DownloadOptions{})
+	assert.ErrorIs(t, err, ErrDigestMismatch)
+	_, err = MeasureRegistry(context.Background(), "library/test:latest", amd64, mirror, common.DownloadOptions{})
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrDigestMismatch, "a tag has no digest to verify the manifest with")
+
+	// Manifests over the size limit fail without being taken for tampering.
+	change = func([]byte) []byte { return make([]byte, maxManifestSize+1) }
+	_, err = MeasureRegistry(context.Background(), pinned, amd64, mirror, common.DownloadOptions{})
+	assert.ErrorContains(t, err, "larger than")
+	assert.NotErrorIs(t, err, ErrDigestMismatch)
+	change = nil
+
+	inspection := InspectRegistry(context.Background(), pinned, mirror)
+	assert.Equal(t, TAG_UNTRUSTED, inspection.Tag(digest))
+}
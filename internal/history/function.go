@@ -0,0 +1,430 @@
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+	"github.com/salehborhani/403Unlocker-cli/internal/network"
+	"github.com/urfave/cli/v2"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	HISTORY_DB_FILE = common.CONFIG_DIR + "/history.db"
+
+	// Kinds of runs that are recorded.
+	KIND_CHECK      = "check"
+	KIND_BESTDNS    = "bestdns"
+	KIND_FASTDOCKER = "fastdocker"
+
+	// CURRENT_NETWORK selects the network this machine is on with --network.
+	CURRENT_NETWORK = "current"
+
+	// Trends reported by Summarize.
+	TREND_UP      = "up"
+	TREND_DOWN    = "down"
+	TREND_STABLE  = "stable"
+	TREND_UNKNOWN = "n/a"
+)
+
+var (
+	// Disabled turns Append into a no-op.
+	Disabled bool
+
+	measurementsBucket = []byte("measurements")
+)
+
+// Measurement is the result of probing one server during one run.
+type Measurement struct {
+	Time           time.Time `json:"time"`
+	Kind           string    `json:"kind"`
+	Target         string    `json:"target"`
+	Server         string    `json:"server"`
+	Network        string    `json:"network,omitempty"`
+	OK             bool      `json:"ok"`
+	Status         string    `json:"status,omitempty"`
+	BytesPerSecond int64     `json:"bytes_per_second,omitempty"`
+}
+
+// Filter selects measurements. Zero fields match everything.
+type Filter struct {
+	Kind    string
+	Target  string
+	Server  string
+	Network string
+	Since   time.Time
+	Until   time.Time
+}
+
+func (f Filter) match(m Measurement) bool {
+	return (f.Kind == "" || f.Kind == m.Kind) &&
+		(f.Target == "" || strings.EqualFold(f.Target, m.Target)) &&
+		(f.Server == "" || f.Server == m.Server) &&
+		(f.Network == "" || f.Network == m.Network) &&
+		(f.Since.IsZero() || !m.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || m.Time.Before(f.Until))
+}
+
+// Store is a bbolt database of measurements keyed by time.
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens, creating if needed, the history database at path.
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, &common.ConfigError{Op: "create directory", Path: filepath.Dir(path), Err: err}
+	}
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("open history %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(measurementsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// OpenDefault opens the history database of the current profile.
+func OpenDefault() (*Store, error) {
+	path, err := common.ConfigPath(HISTORY_DB_FILE)
+	if err != nil {
+		return nil, err
+	}
+	return Open(path)
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Record stores measurements.
+func (s *Store) Record(measurements ...Measurement) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(measurementsBucket)
+		for _, m := range measurements {
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			value, err := json.Marshal(m)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(key(m.Time, seq), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Query returns the measurements matching filter, oldest first.
+func (s *Store) Query(filter Filter) ([]Measurement, error) {
+	var measurements []Measurement
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(measurementsBucket).Cursor()
+		k, v := cursor.First()
+		if !filter.Since.IsZero() {
+			k, v = cursor.Seek(key(filter.Since, 0))
+		}
+		for ; k != nil; k, v = cursor.Next() {
+			var m Measurement
+			if err := json.Unmarshal(v, &m); err != nil {
+				return fmt.Errorf("corrupt history entry: %w", err)
+			}
+			if !filter.Until.IsZero() && !m.Time.Before(filter.Until) {
+				break
+			}
+			if filter.match(m) {
+				measurements = append(measurements, m)
+			}
+		}
+		return nil
+	})
+	return measurements, err
+}
+
+// Append records measurements in the history of the current profile, unless
+// history is Disabled.
+func Append(measurements ...Measurement) error {
+	if Disabled || len(measurements) == 0 {
+		return nil
+	}
+	store, err := OpenDefault()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	return store.Record(measurements...)
+}
+
+// key orders entries by time; seq keeps entries recorded at the same instant apart.
+func key(t time.Time, seq uint64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k
+}
+
+// ServerStats summarizes the measurements of one server.
+type ServerStats struct {
+	Server string
+	Runs   int
+	Up     int
+	// MedianSpeed is the median of the runs in which the server worked and
+	// a speed was measured, check runs only tell whether it works.
+	MedianSpeed int64
+	// Trend is the trend of the speed, UptimeTrend that of the uptime.
+	Trend       string
+	UptimeTrend string
+	LastSeen    time.Time
+}
+
+// Uptime returns the percentage of runs in which the server worked.
+func (s ServerStats) Uptime() float64 {
+	if s.Runs == 0 {
+		return 0
+	}
+	return float64(s.Up) * 100 / float64(s.Runs)
+}
+
+// ByNetwork groups measurements by the network they were taken on, the
+// network with the latest measurement first.
+func ByNetwork(measurements []Measurement) [][]Measurement {
+	index := make(map[string]int)
+	var groups [][]Measurement
+	for _, m := range measurements {
+		i, ok := index[m.Network]
+		if !ok {
+			i = len(groups)
+			index[m.Network] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], m)
+	}
+	latest := func(ms []Measurement) time.Time {
+		t := ms[0].Time
+		for _, m := range ms[1:] {
+			if m.Time.After(t) {
+				t = m.Time
+			}
+		}
+		return t
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return latest(groups[i]).After(latest(groups[j])) })
+	return groups
+}
+
+// Summarize groups measurements by server. Servers are ordered by uptime,
+// then by median speed.
+func Summarize(measurements []Measurement) []ServerStats {
+	byServer := make(map[string][]Measurement)
+	for _, m := range measurements {
+		byServer[m.Server] = append(byServer[m.Server], m)
+	}
+
+	stats := make([]ServerStats, 0, len(byServer))
+	for server, ms := range byServer {
+		sort.Slice(ms, func(i, j int) bool { return ms[i].Time.Before(ms[j].Time) })
+		s := ServerStats{Server: server, Runs: len(ms), LastSeen: ms[len(ms)-1].Time}
+		for _, m := range ms {
+			if m.OK {
+				s.Up++
+			}
+		}
+		s.MedianSpeed = medianSpeed(ms)
+		s.Trend, s.UptimeTrend = trend(withSpeed(ms), medianSpeed), trend(ms, uptime)
+		stats = append(stats, s)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Uptime() != stats[j].Uptime() {
+			return stats[i].Uptime() > stats[j].Uptime()
+		}
+		if stats[i].MedianSpeed != stats[j].MedianSpeed {
+			return stats[i].MedianSpeed > stats[j].MedianSpeed
+		}
+		return stats[i].Server < stats[j].Server
+	})
+	return stats
+}
+
+// trend compares metric of the older half of the runs with that of the newer
+// half. It is unknown when there are too few runs or metric is 0 for both.
+func trend[T int64 | float64](ms []Measurement, metric func([]Measurement) T) string {
+	if len(ms) < 4 {
+		return TREND_UNKNOWN
+	}
+	older, newer := ms[:len(ms)/2], ms[len(ms)/2:]
+
+	before, after := float64(metric(older)), float64(metric(newer))
+	switch {
+	case before == 0 && after == 0:
+		return TREND_UNKNOWN
+	case after > before*1.1:
+		return TREND_UP
+	case after < before*0.9:
+		return TREND_DOWN
+	}
+	return TREND_STABLE
+}
+
+// withSpeed returns the runs that measured a speed: benchmarks, not checks.
+func withSpeed(ms []Measurement) []Measurement {
+	var measured []Measurement
+	for _, m := range ms {
+		if m.Kind != KIND_CHECK {
+			measured = append(measured, m)
+		}
+	}
+	return measured
+}
+
+// medianSpeed is the median speed of the runs that worked and measured a
+// speed, failed runs and checks have none.
+func medianSpeed(ms []Measurement) int64 {
+	speeds := make([]int64, 0, len(ms))
+	for _, m := range ms {
+		if m.OK && m.Kind != KIND_CHECK {
+			speeds = append(speeds, m.BytesPerSecond)
+		}
+	}
+	sort.Slice(speeds, func(i, j int) bool { return speeds[i] < speeds[j] })
+	switch {
+	case len(speeds) == 0:
+		return 0
+	case len(speeds)%2 == 1:
+		return speeds[len(speeds)/2]
+	}
+	return (speeds[len(speeds)/2-1] + speeds[len(speeds)/2]) / 2
+}
+
+func uptime(ms []Measurement) float64 {
+	up := 0
+	for _, m := range ms {
+		if m.OK {
+			up++
+		}
+	}
+	return float64(up) / float64(len(ms))
+}
+
+// ShowHistory prints uptime, median speed and their trends per server, ranked
+// separately for every network the measurements were taken on.
+func ShowHistory(c *cli.Context) error {
+	now := time.Now()
+	filter := Filter{
+		Kind:    c.String("kind"),
+		Target:  c.String("domain"),
+		Server:  c.String("server"),
+		Network: c.String("network"),
+	}
+	if filter.Network == CURRENT_NETWORK {
+		filter.Network = network.Current(c.Context).ID()
+	}
+	var err error
+	if filter.Since, err = ParseTime(c.String("since"), now); err != nil {
+		return fmt.Errorf("%w: --since: %v", common.ErrInvalidInput, err)
+	}
+	if filter.Until, err = ParseTime(c.String("until"), now); err != nil {
+		return fmt.Errorf("%w: --until: %v", common.ErrInvalidInput, err)
+	}
+
+	store, err := OpenDefault()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	measurements, err := store.Query(filter)
+	if err != nil {
+		return err
+	}
+	if len(measurements) == 0 {
+		fmt.Println("No history recorded for this selection yet.")
+		return nil
+	}
+
+	for _, ms := range ByNetwork(measurements) {
+		id := ms[0].Network
+		if id == "" {
+			id = network.UNKNOWN_NETWORK
+		}
+		fmt.Printf("\nNetwork %s: %d measurements from %s to %s\n\n",
+			network.Describe(id),
+			len(ms),
+			ms[0].Time.Format("2006-01-02 15:04"),
+			ms[len(ms)-1].Time.Format("2006-01-02 15:04"))
+		printRanking(Summarize(ms))
+	}
+	return nil
+}
+
+// printRanking prints stats as a table.
+func printRanking(stats []ServerStats) {
+	table := common.NewTable("Server", "Runs", "Uptime", "Uptime Trend", "Median Speed", "Speed Trend", "Last Seen")
+	for _, s := range stats {
+		speed := "-"
+		if s.MedianSpeed > 0 {
+			speed = common.FormatDataSize(s.MedianSpeed) + "/s"
+		}
+		table.AddRow(
+			common.Plain(s.Server),
+			common.Plain(strconv.Itoa(s.Runs)),
+			common.Plain(fmt.Sprintf("%.1f%%", s.Uptime())),
+			common.Colored(trendColor(s.UptimeTrend), s.UptimeTrend),
+			common.Plain(speed),
+			common.Colored(trendColor(s.Trend), s.Trend),
+			common.Plain(s.LastSeen.Format("2006-01-02 15:04")),
+		)
+	}
+	table.Print()
+}
+
+func trendColor(trend string) string {
+	switch trend {
+	case TREND_UP:
+		return common.Green
+	case TREND_DOWN:
+		return common.Red
+	}
+	return ""
+}
+
+// ParseTime parses an absolute date (2006-01-02 or RFC 3339) or a duration
+// before now such as 36h or 7d. An empty value is the zero time.
+func ParseTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected a date, RFC 3339 time or duration such as 7d", value)
+}
@@ -0,0 +1,134 @@
+package history
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreQuery(t *testing.T) {
+	store, err := Open(filepath.Join(t.TempDir(), "history.db"))
+	assert.NoError(t, err)
+	defer store.Close()
+
+	day := time.Date(2025, 1, 1, 8, 0, 0, 0, time.UTC)
+	assert.NoError(t, store.Record(
+		Measurement{Time: day, Kind: KIND_BESTDNS, Target: "registry.npmjs.org", Server: "10.202.10.202", OK: true, BytesPerSecond: 100},
+		Measurement{Time: day, Kind: KIND_BESTDNS, Target: "registry.npmjs.org", Server: "178.22.122.100", OK: false},
+		Measurement{Time: day.AddDate(0, 0, 1), Kind: KIND_CHECK, Target: "pkg.go.dev", Server: "10.202.10.202", OK: true},
+		Measurement{Time: day.AddDate(0, 0, 2), Kind: KIND_BESTDNS, Target: "registry.npmjs.org", Server: "10.202.10.202", Network: "office", OK: true, BytesPerSecond: 200},
+	))
+
+	all, err := store.Query(Filter{})
+	assert.NoError(t, err)
+	assert.Len(t, all, 4)
+
+	byDomain, err := store.Query(Filter{Target: "Registry.npmjs.org"})
+	assert.NoError(t, err)
+	assert.Len(t, byDomain, 3)
+
+	byRange, err := store.Query(Filter{Since: day.Add(time.Hour), Until: day.AddDate(0, 0, 2)})
+	assert.NoError(t, err)
+	assert.Len(t, byRange, 1)
+	assert.Equal(t, KIND_CHECK, byRange[0].Kind)
+
+	byNetwork, err := store.Query(Filter{Network: "office"})
+	assert.NoError(t, err)
+	assert.Len(t, byNetwork, 1)
+	assert.Equal(t, int64(200), byNetwork[0].BytesPerSecond)
+}
+
+func TestByNetwork(t *testing.T) {
+	day := time.Date(2025, 1, 1, 8, 0, 0, 0, time.UTC)
+	groups := ByNetwork([]Measurement{
+		{Time: day, Server: "a", Network: "home"},
+		{Time: day, Server: "b", Network: "office"},
+		{Time: day.Add(time.Hour), Server: "a", Network: "home"},
+		{Time: day.Add(2 * time.Hour), Server: "a", Network: "office"},
+	})
+	assert.Len(t, groups, 2)
+	assert.Equal(t, "office", groups[0][0].Network, "the network used last comes first")
+	assert.Len(t, groups[0], 2)
+	assert.Equal(t, "home", groups[1][0].Network)
+	assert.Len(t, groups[1], 2)
+}
+
+func TestSummarize(t *testing.T) {
+	start := time.Date(2025, 1, 1, 8, 0, 0, 0, time.UTC)
+	var measurements []Measurement
+	for i, speed := range []int64{100, 100, 300, 300} {
+		measurements = append(measurements,
+			Measurement{Time: start.AddDate(0, 0, i), Server: "fast", OK: true, BytesPerSecond: speed},
+			Measurement{Time: start.AddDate(0, 0, i), Server: "flaky", OK: i < 2},
+			Measurement{Time: start.AddDate(0, 0, i), Server: "failing", OK: i%2 == 0, BytesPerSecond: 400 * int64(1-i%2)},
+		)
+	}
+	measurements = append(measurements, Measurement{Time: start, Server: "new", OK: true, BytesPerSecond: 50})
+
+	stats := Summarize(measurements)
+	assert.Len(t, stats, 4)
+
+	assert.Equal(t, "fast", stats[0].Server)
+	assert.Equal(t, 100.0, stats[0].Uptime())
+	assert.Equal(t, int64(200), stats[0].MedianSpeed)
+	assert.Equal(t, TREND_UP, stats[0].Trend)
+	assert.Equal(t, TREND_STABLE, stats[0].UptimeTrend)
+
+	assert.Equal(t, "new", stats[1].Server)
+	assert.Equal(t, TREND_UNKNOWN, stats[1].Trend)
+
+	// Failed runs count against the uptime, not the speed.
+	assert.Equal(t, "failing", stats[2].Server)
+	assert.Equal(t, 50.0, stats[2].Uptime())
+	assert.Equal(t, int64(400), stats[2].MedianSpeed)
+	assert.Equal(t, TREND_STABLE, stats[2].Trend)
+	assert.Equal(t, TREND_STABLE, stats[2].UptimeTrend)
+
+	assert.Equal(t, "flaky", stats[3].Server)
+	assert.Equal(t, 50.0, stats[3].Uptime())
+	assert.Equal(t, TREND_UNKNOWN, stats[3].Trend, "no speed was measured")
+	assert.Equal(t, TREND_DOWN, stats[3].UptimeTrend)
+}
+
+func TestSummarizeIgnoresCheckSpeed(t *testing.T) {
+	start := time.Date(2025, 1, 1, 8, 0, 0, 0, time.UTC)
+	var measurements []Measurement
+	for i := 0; i < 4; i++ {
+		measurements = append(measurements,
+			Measurement{Time: start.AddDate(0, 0, i), Kind: KIND_BESTDNS, Server: "dns", OK: true, BytesPerSecond: 200},
+			Measurement{Time: start.AddDate(0, 0, 4+i), Kind: KIND_CHECK, Server: "dns", OK: true},
+		)
+	}
+
+	stats := Summarize(measurements)
+	assert.Len(t, stats, 1)
+	assert.Equal(t, 8, stats[0].Runs)
+	assert.Equal(t, int64(200), stats[0].MedianSpeed)
+	assert.Equal(t, TREND_STABLE, stats[0].Trend, "checks that came later have no speed")
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2025, 1, 31, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		value    string
+		expected time.Time
+		wantErr  bool
+	}{
+		{"Empty", "", time.Time{}, false},
+		{"Days", "7d", now.AddDate(0, 0, -7), false},
+		{"Duration", "36h", now.Add(-36 * time.Hour), false},
+		{"RFC 3339", "2025-01-02T03:04:05Z", time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC), false},
+		{"Invalid", "last week", time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ParseTime(tt.value, now)
+			assert.Equal(t, tt.wantErr, err != nil, "Test case: %s", tt.name)
+			assert.True(t, tt.expected.Equal(result), "Test case: %s", tt.name)
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+
+	"github.com/salehborhani/403Unlocker-cli/internal/check"
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+	"github.com/salehborhani/403Unlocker-cli/internal/dns"
+	"github.com/salehborhani/403Unlocker-cli/internal/docker"
+	"github.com/salehborhani/403Unlocker-cli/internal/history"
+	"github.com/urfave/cli/v2"
+)
+
+const DEFAULT_LISTEN = ":9403"
+
+// Targets are what each collection round probes.
+type Targets struct {
+	// Check URLs are requested through every DNS server (like check).
+	Check []string
+	// Download URLs are benchmarked through every DNS server (like bestdns).
+	Download []string
+	// Images are pulled from every registry (like fastdocker).
+	Images []string
+	// Platform is the platform of Images that is pulled.
+	Platform v1.Platform
+	// Timeout limits each download and pull.
+	Timeout time.Duration
+	// CheckTimeouts limit the requests to Check URLs.
+	CheckTimeouts common.Timeouts
+}
+
+// Collect runs one round of probes against targets and stores the results in
+// registry, dropping the series of servers that are no longer probed. It
+// stops early when ctx is cancelled.
+func Collect(ctx context.Context, registry *Registry, targets Targets, dnsList []string, registries []docker.Registry) {
+	registry.BeginRound()
+	defer func() {
+		if ctx.Err() == nil {
+			registry.EndRound()
+		}
+	}()
+
+	for _, target := range targets.Check {
+		url := check.EnsureHTTPS(target)
+		started := time.Now()
+		results := check.Probe(ctx, url, dnsList, targets.CheckTimeouts, nil)
+		check.RecordHistory(ctx, history.KIND_CHECK, url, started, results)
+
+		working := 0
+		for _, result := range results {
+			labels := []Label{{"target", target}, {"server", result.Server}}
+			registry.Set("unlocker_check_success", "Whether the target answered 200 OK through the DNS server.", labels, boolToFloat(result.OK()))
+			registry.Set("unlocker_check_http_status", "HTTP status code of the target through the DNS server, 0 when the request failed.", labels, float64(result.StatusCode))
+			if result.Err == nil {
+				registry.Observe("unlocker_check_latency_seconds", "Time until the target answered through the DNS server.", DefaultLatencyBuckets, labels, result.Latency.Seconds())
+			}
+			if result.OK() {
+				working++
+			}
+		}
+		recordRound(registry, history.KIND_CHECK, target, started, working)
+	}
+
+	for _, target := range targets.Download {
+		started := time.Now()
+		sizes := dns.Benchmark(ctx, target, dnsList, targets.Timeout, common.DownloadOptions{}, nil)
+		dns.RecordBenchmark(ctx, target, started, targets.Timeout, sizes)
+
+		working := 0
+		for server, size := range sizes {
+			labels := []Label{{"target", target}, {"server", server}}
+			registry.Set("unlocker_download_success", "Whether any data of the target could be downloaded through the DNS server.", labels, boolToFloat(size > 0))
+			registry.Set("unlocker_download_bytes_per_second", "Download throughput of the target through the DNS server.", labels, float64(size)/targets.Timeout.Seconds())
+			if size > 0 {
+				working++
+			}
+		}
+		recordRound(registry, history.KIND_BESTDNS, target, started, working)
+	}
+
+	for _, image := range targets.Images {
+		started := time.Now()
+		results := docker.Benchmark(ctx, image, targets.Platform, registries, targets.Timeout, common.DownloadOptions{}, nil)
+		docker.RecordHistory(ctx, image, started, targets.Timeout, results)
+
+		working := 0
+		for _, result := range results {
+			labels := []Label{{"image", image}, {"registry", result.Registry}}
+			ok := result.Err == nil && result.Bytes > 0
+			registry.Set("unlocker_registry_pull_success", "Whether any data of the image could be pulled from the registry.", labels, boolToFloat(ok))
+			registry.Set("unlocker_registry_pull_bytes_per_second", "Pull throughput of the image from the registry.", labels, float64(result.Bytes)/targets.Timeout.Seconds())
+			registry.Set("unlocker_registry_auth_seconds", "Time to ping the registry and get a pull token, 0 when it failed.", labels, result.Phases.Auth.Seconds())
+			registry.Set("unlocker_registry_manifest_seconds", "Time to get the image manifest from the registry, 0 when it failed.", labels, result.Phases.Manifest.Seconds())
+			if ok {
+				working++
+			}
+		}
+		recordRound(registry, history.KIND_FASTDOCKER, image, started, working)
+	}
+}
+
+func recordRound(registry *Registry, kind, target string, started time.Time, working int) {
+	labels := []Label{{"kind", kind}, {"target", target}}
+	registry.Set("unlocker_probe_duration_seconds", "Duration of the last probe round.", labels, time.Since(started).Seconds())
+	registry.Set("unlocker_probe_working_servers", "Number of servers that worked in the last probe round.", labels, float64(working))
+	registry.Set("unlocker_probe_last_run_timestamp_seconds", "Unix time of the last probe round.", labels, float64(started.Unix()))
+}
+
+// readLists reads the DNS servers and, when images are probed, the registries.
+func readLists(targets Targets) ([]string, []docker.Registry, error) {
+	dnsList, err := common.ReadOrDownloadConfig(common.DNS_CONFIG_FILE, common.DNS_CONFIG_URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	var registries []docker.Registry
+	if len(targets.Images) > 0 {
+		registries, err = docker.ReadRegistries()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return dnsList, registries, nil
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Serve probes the configured targets every interval and exposes the results on /metrics.
+func Serve(c *cli.Context) error {
+	ctx := c.Context
+
+	platform, err := docker.PlatformFlag(c)
+	if err != nil {
+		return err
+	}
+	targets := Targets{
+		Check:    c.StringSlice("check"),
+		Download: c.StringSlice("download"),
+		Images:   c.StringSlice("image"),
+		Platform: platform,
+		Timeout:  time.Duration(c.Int("timeout")) * time.Second,
+
+		CheckTimeouts: check.TimeoutsFlag(c, "check-timeout"),
+	}
+	dnsList, registries, err := readLists(targets)
+	if err != nil {
+		return err
+	}
+
+	registry := NewRegistry()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("403unlocker metrics exporter, see /metrics\n"))
+	})
+	server := &http.Server{Addr: c.String("listen"), Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		interval := c.Duration("interval")
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			Collect(ctx, registry, targets, dnsList, registries)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			// The lists are read again every round, so servers removed
+			// from them stop being probed and reported.
+			if d, r, err := readLists(targets); err != nil {
+				log.Printf("Using the previous DNS and registry lists: %v", err)
+			} else {
+				dnsList, registries = d, r
+			}
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Printf("Serving metrics on %s/metrics\n", server.Addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
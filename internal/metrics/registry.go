@@ -0,0 +1,228 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Label is a Prometheus label pair.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// DefaultLatencyBuckets are the histogram buckets, in seconds, used for request latency.
+var DefaultLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type series struct {
+	labels string
+	value  float64
+
+	// Histogram only.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    string
+	buckets []float64
+	series  map[string]*series
+}
+
+// Registry holds gauges and histograms and renders them in the Prometheus
+// text exposition format. It is safe for concurrent use.
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+	// touched are the label sets updated since BeginRound, nil outside of
+	// rounds.
+	touched map[string]bool
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Set sets the gauge name with the given labels to value.
+func (r *Registry) Set(name, help string, labels []Label, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.series(name, help, "gauge", nil, labels).value = value
+}
+
+// Observe adds value to the histogram name with the given labels.
+func (r *Registry) Observe(name, help string, buckets []float64, labels []Label, value float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.series(name, help, "histogram", buckets, labels)
+	for i, bound := range r.families[name].buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// BeginRound starts a collection round, see EndRound.
+func (r *Registry) BeginRound() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.touched = make(map[string]bool)
+}
+
+// EndRound deletes the series whose labels were not updated in any metric
+// since BeginRound, such as those of servers removed from the config. A
+// server that only failed keeps its histograms, as its gauges were updated.
+func (r *Registry) EndRound() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.touched == nil {
+		return
+	}
+	for name, f := range r.families {
+		for key := range f.series {
+			if !r.touched[key] {
+				delete(f.series, key)
+			}
+		}
+		if len(f.series) == 0 {
+			delete(r.families, name)
+		}
+	}
+	r.touched = nil
+}
+
+func (r *Registry) series(name, help, kind string, buckets []float64, labels []Label) *series {
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, kind: kind, buckets: buckets, series: make(map[string]*series)}
+		r.families[name] = f
+	}
+	key := formatLabels(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: key, counts: make([]uint64, len(f.buckets))}
+		f.series[key] = s
+	}
+	if r.touched != nil {
+		r.touched[key] = true
+	}
+	return s
+}
+
+// WriteTo renders every metric, sorted by name and labels.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	for _, name := range names {
+		f := r.families[name]
+		fmt.Fprintf(cw, "# HELP %s %s\n", f.name, escape(f.help, false))
+		fmt.Fprintf(cw, "# TYPE %s %s\n", f.name, f.kind)
+
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := f.series[key]
+			if f.kind == "gauge" {
+				fmt.Fprintf(cw, "%s%s %s\n", f.name, braces(s.labels), formatFloat(s.value))
+				continue
+			}
+			for i, bound := range f.buckets {
+				fmt.Fprintf(cw, "%s_bucket%s %d\n", f.name, braces(joinLabels(s.labels, `le="`+formatFloat(bound)+`"`)), s.counts[i])
+			}
+			fmt.Fprintf(cw, "%s_bucket%s %d\n", f.name, braces(joinLabels(s.labels, `le="+Inf"`)), s.count)
+			fmt.Fprintf(cw, "%s_sum%s %s\n", f.name, braces(s.labels), formatFloat(s.sum))
+			fmt.Fprintf(cw, "%s_count%s %d\n", f.name, braces(s.labels), s.count)
+		}
+	}
+	if err := cw.w.Flush(); err != nil {
+		return cw.n, err
+	}
+	return cw.n, cw.err
+}
+
+// ServeHTTP serves the metrics in the text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+func formatLabels(labels []Label) string {
+	parts := make([]string, 0, len(labels))
+	for _, label := range labels {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, label.Name, escape(label.Value, true)))
+	}
+	return strings.Join(parts, ",")
+}
+
+func joinLabels(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func escape(value string, quote bool) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	if quote {
+		value = strings.ReplaceAll(value, `"`, `\"`)
+	}
+	return value
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	registry := NewRegistry()
+	labels := []Label{{"target", "pkg.go.dev"}, {"server", "10.202.10.202"}}
+	registry.Set("unlocker_check_success", "Whether the target answered.", labels, 1)
+	registry.Set("unlocker_check_success", "Whether the target answered.", []Label{{"target", "pkg.go.dev"}, {"server", "1.1.1.1"}}, 0)
+	registry.Observe("unlocker_check_latency_seconds", "Latency.", []float64{0.1, 1}, labels, 0.5)
+	registry.Observe("unlocker_check_latency_seconds", "Latency.", []float64{0.1, 1}, labels, 2)
+
+	var b strings.Builder
+	_, err := registry.WriteTo(&b)
+	assert.NoError(t, err)
+
+	expected := `# HELP unlocker_check_latency_seconds Latency.
+# TYPE unlocker_check_latency_seconds histogram
+unlocker_check_latency_seconds_bucket{target="pkg.go.dev",server="10.202.10.202",le="0.1"} 0
+unlocker_check_latency_seconds_bucket{target="pkg.go.dev",server="10.202.10.202",le="1"} 1
+unlocker_check_latency_seconds_bucket{target="pkg.go.dev",server="10.202.10.202",le="+Inf"} 2
+unlocker_check_latency_seconds_sum{target="pkg.go.dev",server="10.202.10.202"} 2.5
+unlocker_check_latency_seconds_count{target="pkg.go.dev",server="10.202.10.202"} 2
+# HELP unlocker_check_success Whether the target answered.
+# TYPE unlocker_check_success gauge
+unlocker_check_success{target="pkg.go.dev",server="1.1.1.1"} 0
+unlocker_check_success{target="pkg.go.dev",server="10.202.10.202"} 1
+`
+	assert.Equal(t, expected, b.String())
+}
+
+func TestRegistryEscapesLabels(t *testing.T) {
+	registry := NewRegistry()
+	registry.Set("unlocker_test", "Test.", []Label{{"target", "a\"b\\c\nd"}}, 1)
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Contains(t, recorder.Body.String(), `unlocker_test{target="a\"b\\c\nd"} 1`)
+	assert.Contains(t, recorder.Header().Get("Content-Type"), "text/plain")
+}
+
+func TestRegistryEndRound(t *testing.T) {
+	registry := NewRegistry()
+	kept := []Label{{"target", "pkg.go.dev"}, {"server", "10.202.10.202"}}
+	removed := []Label{{"target", "pkg.go.dev"}, {"server", "1.1.1.1"}}
+	registry.BeginRound()
+	registry.Set("unlocker_check_success", "Whether the target answered.", kept, 1)
+	registry.Set("unlocker_check_success", "Whether the target answered.", removed, 1)
+	registry.Observe("unlocker_check_latency_seconds", "Latency.", []float64{1}, kept, 0.5)
+	registry.Observe("unlocker_removed_latency_seconds", "Latency.", []float64{1}, removed, 0.5)
+	registry.EndRound()
+
+	// The server that only failed keeps its latency histogram.
+	registry.BeginRound()
+	registry.Set("unlocker_check_success", "Whether the target answered.", kept, 0)
+	registry.EndRound()
+
+	var b strings.Builder
+	_, err := registry.WriteTo(&b)
+	assert.NoError(t, err)
+	assert.Contains(t, b.String(), `unlocker_check_success{target="pkg.go.dev",server="10.202.10.202"} 0`)
+	assert.Contains(t, b.String(), `unlocker_check_latency_seconds_count{target="pkg.go.dev",server="10.202.10.202"} 1`)
+	assert.NotContains(t, b.String(), "1.1.1.1")
+	assert.NotContains(t, b.String(), "unlocker_removed_latency_seconds", "empty metrics are dropped")
+}
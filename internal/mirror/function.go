@@ -0,0 +1,549 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+	"github.com/salehborhani/403Unlocker-cli/internal/docker"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	DEFAULT_LISTEN = "localhost:5000"
+	// DEFAULT_RANK_IMAGE is pulled from every registry to rank them.
+	DEFAULT_RANK_IMAGE    = "library/alpine:latest"
+	DEFAULT_RANK_INTERVAL = 10 * time.Minute
+	DEFAULT_TIMEOUT       = 10
+	// FAIL_COOLDOWN is how long a registry that failed a request is only
+	// tried after the others.
+	FAIL_COOLDOWN = 30 * time.Second
+	// MAX_MANIFEST_SIZE bounds manifests, which are read whole to verify them.
+	MAX_MANIFEST_SIZE = 4 << 20
+	// MAX_CLIENTS bounds the authenticated clients kept, one per registry and
+	// repository pulled.
+	MAX_CLIENTS = 256
+)
+
+// registryError is an error in the format of the distribution API.
+type registryError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type errorsResponse struct {
+	Errors []registryError `json:"errors"`
+}
+
+// Proxy serves pulls over the OCI distribution API from the registries in
+// dockerRegistry.conf, trying the fastest working one first and failing over
+// to the next one when a request fails. Pushes are not supported.
+type Proxy struct {
+	registries []docker.Registry
+	// cacheDir, if set, keeps verified blobs in cacheDir/blobs/<algorithm>/<hex>.
+	cacheDir string
+	// timeout is how long a registry may take to answer before the next one
+	// is tried.
+	timeout time.Duration
+
+	mu sync.Mutex
+	// ranked is the order registries are tried in, see Rank.
+	ranked    []docker.Registry
+	failed    map[string]time.Time
+	untrusted map[string]bool
+	// clients are authenticated per registry and repository, at most
+	// MAX_CLIENTS of them.
+	clients map[string]*http.Client
+}
+
+// NewProxy returns a Proxy that tries registries in the given order until
+// Rank is called, caches blobs in cacheDir unless it is empty and waits at
+// most timeout for each registry to answer.
+func NewProxy(registries []docker.Registry, cacheDir string, timeout time.Duration) *Proxy {
+	return &Proxy{
+		registries: registries,
+		cacheDir:   cacheDir,
+		timeout:    timeout,
+		ranked:     registries,
+		failed:     make(map[string]time.Time),
+		untrusted:  make(map[string]bool),
+		clients:    make(map[string]*http.Client),
+	}
+}
+
+// Rank benchmarks imageName on every registry like fastdocker and tries them
+// in that order from then on, fastest first and failed ones last. Registries
+// that serve content not matching its digest are never tried again.
+func (p *Proxy) Rank(ctx context.Context, imageName string, platform v1.Platform, timeout time.Duration) []docker.Result {
+	results := docker.Benchmark(ctx, imageName, platform, p.registries, timeout, common.DownloadOptions{}, nil)
+	if ctx.Err() != nil {
+		return results
+	}
+	docker.SortResults(results)
+
+	ranked := make([]docker.Registry, 0, len(results))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, result := range results {
+		if result.Untrusted() {
+			p.untrusted[result.Registry] = true
+		}
+		ranked = append(ranked, docker.Lookup(p.registries, result.Registry))
+	}
+	p.ranked = ranked
+	return results
+}
+
+// Order returns the registries in the order the next request tries them:
+// by rank, with the ones that failed in the last FAIL_COOLDOWN at the end
+// and without untrusted ones.
+func (p *Proxy) Order() []docker.Registry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var order, failed []docker.Registry
+	for _, registry := range p.ranked {
+		switch {
+		case p.untrusted[registry.Host]:
+		case time.Since(p.failed[registry.Host]) < FAIL_COOLDOWN:
+			failed = append(failed, registry)
+		default:
+			order = append(order, registry)
+		}
+	}
+	return append(order, failed...)
+}
+
+func (p *Proxy) fail(registry string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failed[registry] = time.Now()
+}
+
+func (p *Proxy) distrust(registry string, err error) {
+	log.Printf("Not using %s anymore: %v", registry, err)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.untrusted[registry] = true
+	for key := range p.clients {
+		if strings.HasPrefix(key, registry+" ") {
+			delete(p.clients, key)
+		}
+	}
+}
+
+// untrustedHosts returns the registries that are not used anymore.
+func (p *Proxy) untrustedHosts() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var hosts []string
+	for _, registry := range p.registries {
+		if p.untrusted[registry.Host] {
+			hosts = append(hosts, registry.Host)
+		}
+	}
+	return hosts
+}
+
+func (p *Proxy) client(ctx context.Context, registry docker.Registry, repo name.Repository) (*http.Client, error) {
+	key := registry.Host + " " + repo.String()
+	p.mu.Lock()
+	client := p.clients[key]
+	p.mu.Unlock()
+	if client != nil {
+		return client, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	client, err := registry.Client(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// Evicting an arbitrary client only costs it another authentication.
+	if len(p.clients) >= MAX_CLIENTS {
+		for evicted := range p.clients {
+			delete(p.clients, evicted)
+			break
+		}
+	}
+	p.clients[key] = client
+	return client, nil
+}
+
+// splitPath splits a distribution API path such as
+// /v2/library/alpine/manifests/latest into repository, kind and identifier.
+func splitPath(path string) (repo, kind, identifier string, ok bool) {
+	rest, ok := strings.CutPrefix(path, "/v2/")
+	if !ok {
+		return "", "", "", false
+	}
+	for _, kind := range []string{"manifests", "blobs"} {
+		i := strings.LastIndex(rest, "/"+kind+"/")
+		if i <= 0 {
+			continue
+		}
+		identifier := rest[i+len(kind)+2:]
+		if identifier != "" && !strings.Contains(identifier, "/") {
+			return rest[:i], kind, identifier, true
+		}
+	}
+	return "", "", "", false
+}
+
+// ServeHTTP implements the pull side of the distribution API. Repositories
+// are Docker Hub's unless the ns query parameter, which containerd sends to
+// mirrors, names another registry.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the mirror only serves pulls")
+		return
+	}
+	if r.URL.Path == "/v2/" || r.URL.Path == "/v2" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+		return
+	}
+	repoPath, kind, identifier, ok := splitPath(r.URL.Path)
+	if !ok {
+		writeError(w, http.StatusNotFound, "UNSUPPORTED", "unknown path "+r.URL.Path)
+		return
+	}
+
+	upstream := r.URL.Query().Get("ns")
+	if upstream == "" {
+		upstream = name.DefaultRegistry
+	}
+	separator := ":"
+	if strings.Contains(identifier, ":") {
+		separator = "@"
+	} else if kind == "blobs" {
+		writeError(w, http.StatusBadRequest, "DIGEST_INVALID", "invalid digest "+identifier)
+		return
+	}
+	ref, err := name.ParseReference(upstream + "/" + repoPath + separator + identifier)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "NAME_INVALID", err.Error())
+		return
+	}
+
+	var digest v1.Hash
+	if separator == "@" {
+		if digest, err = v1.NewHash(identifier); err != nil {
+			writeError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+			return
+		}
+	}
+	if kind == "blobs" && p.serveCached(w, r, digest) {
+		return
+	}
+	p.forward(w, r, ref, kind, digest)
+}
+
+// forward answers r from the first registry in Order that serves ref.
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request, ref name.Reference, kind string, digest v1.Hash) {
+	order := p.Order()
+	if len(order) == 0 {
+		reason := "no registries are configured"
+		if untrusted := p.untrustedHosts(); len(untrusted) > 0 {
+			reason = "every registry served content not matching its digest and is not used anymore: " + strings.Join(untrusted, ", ")
+		}
+		log.Printf("No registry could serve %s %s: %s", kind, ref, reason)
+		writeError(w, http.StatusBadGateway, "UNKNOWN", fmt.Sprintf("no registry could serve %s: %s", ref, reason))
+		return
+	}
+
+	var errs []string
+	found := true
+	for _, registry := range order {
+		resp, err := p.fetch(r, registry, ref, kind)
+		if err == nil && kind == "manifests" {
+			err = p.relayManifest(w, r, resp, digest)
+			if errors.Is(err, docker.ErrDigestMismatch) {
+				p.distrust(registry.Host, err)
+			}
+		}
+		if err == nil {
+			if kind == "blobs" {
+				p.relayBlob(w, r, resp, registry.Host, digest)
+			}
+			return
+		}
+
+		var terr *transport.Error
+		if !errors.As(err, &terr) || terr.StatusCode != http.StatusNotFound {
+			found = false
+			p.fail(registry.Host)
+		}
+		errs = append(errs, registry.Host+": "+err.Error())
+	}
+
+	if found {
+		code := "MANIFEST_UNKNOWN"
+		if kind == "blobs" {
+			code = "BLOB_UNKNOWN"
+		}
+		writeError(w, http.StatusNotFound, code, fmt.Sprintf("no registry has %s", ref))
+		return
+	}
+	log.Printf("No registry could serve %s %s: %s", kind, ref, strings.Join(errs, "; "))
+	writeError(w, http.StatusBadGateway, "UNKNOWN", fmt.Sprintf("no registry could serve %s: %s", ref, strings.Join(errs, "; ")))
+}
+
+// fetch sends r to registry for ref, mapped to the path the registry serves
+// it under. It fails unless the registry answers within the timeout with
+// the content.
+func (p *Proxy) fetch(r *http.Request, registry docker.Registry, ref name.Reference, kind string) (*http.Response, error) {
+	mirrorRef, err := registry.Reference(ref.Name())
+	if err != nil {
+		return nil, err
+	}
+	repo := mirrorRef.Context()
+	client, err := p.client(r.Context(), registry, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	url := fmt.Sprintf("%s://%s/v2/%s/%s/%s", repo.Scheme(), repo.RegistryStr(), repo.RepositoryStr(), kind, ref.Identifier())
+	req, err := http.NewRequestWithContext(ctx, r.Method, url, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	for _, header := range []string{"Accept", "Range"} {
+		for _, value := range r.Header.Values(header) {
+			req.Header.Add(header, value)
+		}
+	}
+
+	timer := time.AfterFunc(p.timeout, cancel)
+	resp, err := client.Do(req)
+	timer.Stop()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := transport.CheckError(resp, http.StatusOK, http.StatusPartialContent); err != nil {
+		resp.Body.Close()
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+// cancelBody cancels the request context once the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// relayHeaders are the response headers passed on to the client.
+var relayHeaders = []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges", "Docker-Content-Digest", "Etag"}
+
+func copyHeaders(w http.ResponseWriter, resp *http.Response) {
+	for _, header := range relayHeaders {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+}
+
+// relayManifest reads the manifest in resp and, unless it does not match
+// digest, writes it to w. Nothing is written when it fails, so the next
+// registry can be tried.
+func (p *Proxy) relayManifest(w http.ResponseWriter, r *http.Request, resp *http.Response, digest v1.Hash) error {
+	defer resp.Body.Close()
+	if r.Method == http.MethodHead {
+		copyHeaders(w, resp)
+		w.WriteHeader(resp.StatusCode)
+		return nil
+	}
+
+	// One byte more is read, so larger manifests fail instead of being cut
+	// off and then failing verification.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MAX_MANIFEST_SIZE+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > MAX_MANIFEST_SIZE {
+		return fmt.Errorf("manifest is larger than %s", common.FormatDataSize(MAX_MANIFEST_SIZE))
+	}
+	got, _, err := v1.SHA256(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if digest != (v1.Hash{}) && got != digest {
+		return fmt.Errorf("%w: manifest %s has digest %s", docker.ErrDigestMismatch, digest, got)
+	}
+	copyHeaders(w, resp)
+	w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+	w.Header().Set("Docker-Content-Digest", got.String())
+	w.WriteHeader(resp.StatusCode)
+	w.Write(body)
+	return nil
+}
+
+// relayBlob streams the blob in resp to w, verifying it on the way. Verified
+// blobs are added to the cache; a registry serving a blob that does not match
+// its digest is not used anymore, the client notices the mismatch itself.
+func (p *Proxy) relayBlob(w http.ResponseWriter, r *http.Request, resp *http.Response, registry string, digest v1.Hash) {
+	defer resp.Body.Close()
+	copyHeaders(w, resp)
+	w.WriteHeader(resp.StatusCode)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if resp.StatusCode != http.StatusOK || digest.Algorithm != "sha256" {
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	hash := sha256.New()
+	dst := io.MultiWriter(w, hash)
+	var tmp *os.File
+	if p.cacheDir != "" {
+		dir := filepath.Dir(p.cachePath(digest))
+		err := os.MkdirAll(dir, 0o755)
+		if err == nil {
+			tmp, err = os.CreateTemp(dir, digest.Hex+".*.tmp")
+		}
+		if err != nil {
+			log.Printf("Not caching %s: %v", digest, err)
+		} else {
+			defer os.Remove(tmp.Name())
+			defer tmp.Close()
+			dst = io.MultiWriter(dst, tmp)
+		}
+	}
+
+	if _, err := io.Copy(dst, resp.Body); err != nil {
+		return
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != digest.Hex {
+		p.distrust(registry, fmt.Errorf("%w: blob %s has digest sha256:%s", docker.ErrDigestMismatch, digest, got))
+		return
+	}
+	if tmp == nil {
+		return
+	}
+	err := tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), p.cachePath(digest))
+	}
+	if err != nil {
+		log.Printf("Not caching %s: %v", digest, err)
+	}
+}
+
+func (p *Proxy) cachePath(digest v1.Hash) string {
+	return filepath.Join(p.cacheDir, "blobs", digest.Algorithm, digest.Hex)
+}
+
+// serveCached answers r from the blob cache and reports whether it could.
+func (p *Proxy) serveCached(w http.ResponseWriter, r *http.Request, digest v1.Hash) bool {
+	if p.cacheDir == "" {
+		return false
+	}
+	file, err := os.Open(p.cachePath(digest))
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest.String())
+	http.ServeContent(w, r, "", info.ModTime(), file)
+	return true
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorsResponse{[]registryError{{code, message}}})
+}
+
+// Serve runs the registry mirror until interrupted, ranking the registries
+// again every --rank-interval.
+func Serve(c *cli.Context) error {
+	ctx := c.Context
+
+	registries, err := docker.ReadRegistries()
+	if err != nil {
+		return err
+	}
+	platform, err := docker.PlatformFlag(c)
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(c.Int("timeout")) * time.Second
+	proxy := NewProxy(registries, c.String("cache"), timeout)
+	server := &http.Server{
+		Addr:              c.String("listen"),
+		Handler:           proxy,
+		ReadHeaderTimeout: 10 * time.Second,
+		// Cancel running pulls when the mirror is interrupted.
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	go func() {
+		image := c.String("rank-image")
+		ticker := time.NewTicker(c.Duration("rank-interval"))
+		defer ticker.Stop()
+		for {
+			started := time.Now()
+			results := proxy.Rank(ctx, image, platform, timeout)
+			if ctx.Err() != nil {
+				return
+			}
+			docker.RecordHistory(ctx, image, started, timeout, results)
+			log.Printf("Registries ranked on %s: %s", image, strings.Join(docker.Hosts(proxy.Order()), ", "))
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Printf("Serving registry mirror on %s\n", server.Addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/salehborhani/403Unlocker-cli/internal/docker"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRegistry serves the distribution API in-process. Responses to GET
+// requests whose path contains *tamper get their first byte flipped.
+func fakeRegistry(t *testing.T, tamper *string) string {
+	t.Helper()
+	handler := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tamper == nil || *tamper == "" || !strings.Contains(r.URL.Path, *tamper) || r.Method != http.MethodGet {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		body := recorder.Body.Bytes()
+		if len(body) > 0 {
+			body[0] ^= 0xff
+		}
+		for key, values := range recorder.Header() {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(recorder.Code)
+		w.Write(body)
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// brokenRegistry answers every request with 500.
+func brokenRegistry(t *testing.T) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func push(t *testing.T, image string) v1.Image {
+	t.Helper()
+	img, err := random.Image(4096, 2)
+	assert.NoError(t, err)
+	ref, err := name.ParseReference(image)
+	assert.NoError(t, err)
+	assert.NoError(t, remote.Write(ref, img))
+	return img
+}
+
+func serve(t *testing.T, proxy *Proxy) string {
+	t.Helper()
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+func get(t *testing.T, url string) (int, []byte) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if !assert.NoError(t, err) {
+		return 0, nil
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	return resp.StatusCode, body
+}
+
+func TestProxyFailover(t *testing.T) {
+	broken, empty, good := brokenRegistry(t), fakeRegistry(t, nil), fakeRegistry(t, nil)
+	img := push(t, good+"/library/test:latest")
+	push(t, good+"/ghcr.io/owner/app:1")
+	proxy := NewProxy([]docker.Registry{{Host: broken}, {Host: empty}, {Host: good}}, "", 5*time.Second)
+	host := serve(t, proxy)
+
+	ref, err := name.ParseReference(host + "/library/test:latest")
+	assert.NoError(t, err)
+	pulled, err := remote.Image(ref)
+	assert.NoError(t, err)
+	expected, err := img.Digest()
+	assert.NoError(t, err)
+	digest, err := pulled.Digest()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, digest)
+	layers, err := pulled.Layers()
+	assert.NoError(t, err)
+	for _, layer := range layers {
+		rc, err := layer.Compressed()
+		assert.NoError(t, err)
+		_, err = io.Copy(io.Discard, rc)
+		assert.NoError(t, err)
+		rc.Close()
+	}
+	assert.Equal(t, []string{empty, good, broken}, docker.Hosts(proxy.Order()))
+
+	status, _ := get(t, "http://"+host+"/v2/owner/app/manifests/1?ns=ghcr.io")
+	assert.Equal(t, http.StatusOK, status)
+
+	status, body := get(t, "http://"+host+"/v2/library/missing/manifests/latest")
+	assert.Equal(t, http.StatusBadGateway, status)
+	assert.Contains(t, string(body), broken)
+	proxy = NewProxy([]docker.Registry{{Host: empty}, {Host: good}}, "", 5*time.Second)
+	status, body = get(t, "http://"+serve(t, proxy)+"/v2/library/missing/manifests/latest")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Contains(t, string(body), "MANIFEST_UNKNOWN")
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+host+"/v2/library/test/blobs/uploads/", nil)
+	assert.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestProxyVerifiesAndCaches(t *testing.T) {
+	tamper := "/manifests/"
+	tampering := fakeRegistry(t, &tamper)
+	good := fakeRegistry(t, nil)
+	img := push(t, good+"/library/test:latest")
+	ref, err := name.ParseReference(tampering + "/library/test:latest")
+	assert.NoError(t, err)
+	assert.NoError(t, remote.Write(ref, img))
+	digest, err := img.Digest()
+	assert.NoError(t, err)
+
+	cache := t.TempDir()
+	proxy := NewProxy([]docker.Registry{{Host: tampering}, {Host: good}}, cache, 5*time.Second)
+	host := serve(t, proxy)
+
+	status, body := get(t, "http://"+host+"/v2/library/test/manifests/"+digest.String())
+	assert.Equal(t, http.StatusOK, status)
+	manifest, err := img.RawManifest()
+	assert.NoError(t, err)
+	assert.Equal(t, manifest, body)
+	assert.Equal(t, []string{good}, docker.Hosts(proxy.Order()))
+
+	layers, err := img.Layers()
+	assert.NoError(t, err)
+	layer, err := layers[0].Digest()
+	assert.NoError(t, err)
+	blob := "/v2/library/test/blobs/" + layer.String()
+	status, fromRegistry := get(t, "http://"+host+blob)
+	assert.Equal(t, http.StatusOK, status)
+	assert.FileExists(t, filepath.Join(cache, "blobs", "sha256", layer.Hex))
+
+	cached := NewProxy(nil, cache, 5*time.Second)
+	status, fromCache := get(t, "http://"+serve(t, cached)+blob)
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, bytes.Equal(fromRegistry, fromCache))
+
+	// A tampered blob reaches the client, which rejects it, but is neither
+	// cached nor served by the registry again.
+	tamper = "/blobs/"
+	other := NewProxy([]docker.Registry{{Host: tampering}}, t.TempDir(), 5*time.Second)
+	status, _ = get(t, "http://"+serve(t, other)+"/v2/library/test/blobs/"+layer.String())
+	assert.Equal(t, http.StatusOK, status)
+	assert.Empty(t, other.Order())
+	entries, _ := os.ReadDir(filepath.Join(other.cacheDir, "blobs", "sha256"))
+	assert.Empty(t, entries)
+
+	status, body = get(t, "http://"+serve(t, other)+"/v2/library/test/manifests/"+digest.String())
+	assert.Equal(t, http.StatusBadGateway, status, "no trusted registry is left")
+	assert.Contains(t, string(body), tampering)
+}
+
+func TestProxyClientsBounded(t *testing.T) {
+	good := fakeRegistry(t, nil)
+	registry := docker.Registry{Host: good}
+	proxy := NewProxy([]docker.Registry{registry}, "", 5*time.Second)
+	for i := 0; i < MAX_CLIENTS+10; i++ {
+		repo, err := name.NewRepository(fmt.Sprintf("%s/library/test%d", good, i))
+		assert.NoError(t, err)
+		_, err = proxy.client(context.Background(), registry, repo)
+		assert.NoError(t, err)
+	}
+	assert.Len(t, proxy.clients, MAX_CLIENTS)
+
+	proxy.distrust(good, errors.New("tampered"))
+	assert.Empty(t, proxy.clients)
+}
+
+func TestProxyManifestTooLarge(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			w.Write(make([]byte, MAX_MANIFEST_SIZE+1))
+		}
+	}))
+	defer server.Close()
+	large := strings.TrimPrefix(server.URL, "http://")
+	proxy := NewProxy([]docker.Registry{{Host: large}}, "", 5*time.Second)
+
+	status, body := get(t, "http://"+serve(t, proxy)+"/v2/library/test/manifests/sha256:"+strings.Repeat("0", 64))
+	assert.Equal(t, http.StatusBadGateway, status)
+	assert.Contains(t, string(body), "larger than")
+	assert.Equal(t, []string{large}, docker.Hosts(proxy.Order()), "a large manifest is not tampering")
+}
+
+func TestProxyRank(t *testing.T) {
+	broken, good := brokenRegistry(t), fakeRegistry(t, nil)
+	push(t, good+"/library/test:latest")
+	proxy := NewProxy([]docker.Registry{{Host: broken}, {Host: good}}, "", 5*time.Second)
+	assert.Equal(t, []string{broken, good}, docker.Hosts(proxy.Order()))
+
+	results := proxy.Rank(context.Background(), "library/test:latest", v1.Platform{OS: "linux", Architecture: "amd64"}, 5*time.Second)
+	assert.Len(t, results, 2)
+	assert.Equal(t, []string{good, broken}, docker.Hosts(proxy.Order()))
+}
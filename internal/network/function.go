@@ -0,0 +1,307 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+)
+
+const (
+	// DEFAULT_ECHO_URL returns the caller's public IP address as plain text.
+	DEFAULT_ECHO_URL = "https://api.ipify.org"
+
+	// ASN_DB_FILE is an ip2asn-v4.tsv database from https://iptoasn.com.
+	ASN_DB_FILE  = common.CONFIG_DIR + "/ip2asn-v4.tsv"
+	NETWORKS_DIR = common.CONFIG_DIR + "/networks"
+	NETWORK_FILE = "network.conf"
+
+	// UNKNOWN_NETWORK is the ID used when nothing about the network could be detected.
+	UNKNOWN_NETWORK = "unknown"
+)
+
+var (
+	// EchoURL is queried for the public IP address. Empty disables the lookup.
+	EchoURL = DEFAULT_ECHO_URL
+	// ASNDatabase is the ASN database, either an absolute path or a config file name.
+	ASNDatabase = ASN_DB_FILE
+
+	// ErrUnsupported is returned when the default gateway cannot be read on this platform.
+	ErrUnsupported = errors.New("default gateway detection is not supported on this platform")
+
+	current      Fingerprint
+	currentKnown bool
+	currentMu    sync.Mutex
+)
+
+// Fingerprint identifies the network the machine is currently attached to.
+type Fingerprint struct {
+	Gateway    string
+	GatewayMAC string
+	PublicIP   string
+	ASN        string
+	ISP        string
+}
+
+// ID returns a short stable identifier for the network. The gateway hardware
+// address and the ISP's ASN are preferred over the public IP, which many ISPs
+// rotate; the public IP is only used (as a /24) when the ASN is unknown. The
+// gateway is identified by its IP alone when its hardware address is unknown.
+func (f Fingerprint) ID() string {
+	var parts []string
+	switch {
+	case f.Gateway != "" && f.GatewayMAC != "":
+		parts = append(parts, "gw="+f.Gateway+"/"+f.GatewayMAC)
+	case f.Gateway != "":
+		parts = append(parts, "gw="+f.Gateway)
+	}
+	switch {
+	case f.ASN != "":
+		parts = append(parts, "asn="+f.ASN)
+	case f.PublicIP != "":
+		parts = append(parts, "net="+publicPrefix(f.PublicIP))
+	}
+	if len(parts) == 0 {
+		return UNKNOWN_NETWORK
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, ";")))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// String describes the network for humans.
+func (f Fingerprint) String() string {
+	var parts []string
+	if f.ISP != "" || f.ASN != "" {
+		parts = append(parts, strings.TrimSpace(f.ASN+" "+f.ISP))
+	}
+	if f.PublicIP != "" {
+		parts = append(parts, "public IP "+f.PublicIP)
+	}
+	if f.Gateway != "" {
+		parts = append(parts, "gateway "+f.Gateway)
+	}
+	if len(parts) == 0 {
+		return "unknown network"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Detect fingerprints the current network. Every component is best effort;
+// whatever could not be detected is left empty.
+func Detect(ctx context.Context) Fingerprint {
+	var f Fingerprint
+	if gateway, mac, err := DefaultGateway(); err == nil {
+		f.Gateway, f.GatewayMAC = gateway, mac
+	}
+	if EchoURL != "" {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		if ip, err := PublicIP(ctx, EchoURL); err == nil {
+			f.PublicIP = ip
+		}
+	}
+	if f.PublicIP != "" {
+		db := ASNDatabase
+		if !filepath.IsAbs(db) {
+			db, _ = common.ConfigPath(db)
+		}
+		if asn, isp, err := LookupASN(db, f.PublicIP); err == nil {
+			f.ASN, f.ISP = asn, isp
+		}
+	}
+	return f
+}
+
+// Current returns the fingerprint of the current network, detecting it once
+// per run. Detection stops when ctx is done; whatever was found until then is
+// returned but not kept, so the next call detects the network again.
+func Current(ctx context.Context) Fingerprint {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	if !currentKnown {
+		f := Detect(ctx)
+		if ctx.Err() != nil {
+			return f
+		}
+		current, currentKnown = f, true
+	}
+	return current
+}
+
+// PublicIP asks echoURL for the public address of this machine.
+func PublicIP(ctx context.Context, echoURL string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, echoURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("echo endpoint returned %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return "", fmt.Errorf("echo endpoint returned %q, not an IP address", strings.TrimSpace(string(body)))
+	}
+	return ip.String(), nil
+}
+
+// LookupASN finds ip in an ip2asn TSV database (range_start, range_end,
+// AS_number, country_code, AS_description) and returns the AS number and
+// description.
+func LookupASN(dbPath, ip string) (string, string, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return "", "", fmt.Errorf("invalid IP address %q", ip)
+	}
+	target := ipToInt(addr)
+
+	file, err := os.Open(dbPath)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 5 {
+			continue
+		}
+		start, end := net.ParseIP(fields[0]), net.ParseIP(fields[1])
+		if start == nil || end == nil || (start.To4() == nil) != (addr.To4() == nil) {
+			continue
+		}
+		if ipToInt(start).Cmp(target) <= 0 && target.Cmp(ipToInt(end)) <= 0 {
+			if fields[2] == "0" {
+				return "", "", fmt.Errorf("%s is not routed", ip)
+			}
+			return "AS" + fields[2], fields[4], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+	return "", "", fmt.Errorf("%s not found in %s", ip, dbPath)
+}
+
+// CacheFile returns the config file name under which the cache file name is
+// kept for the network with the given ID.
+func CacheFile(name, id string) string {
+	return path.Join(NETWORKS_DIR, id, path.Base(name))
+}
+
+// Remember records the description of f next to its caches, so warnings about
+// stale data can say which network it came from.
+func Remember(f Fingerprint) error {
+	file, err := common.ConfigPath(path.Join(NETWORKS_DIR, f.ID(), NETWORK_FILE))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), os.ModePerm); err != nil {
+		return &common.ConfigError{Op: "create directory", Path: filepath.Dir(file), Err: err}
+	}
+	if err := os.WriteFile(file, []byte(f.String()+"\n"), 0644); err != nil {
+		return &common.ConfigError{Op: "write", Path: file, Err: err}
+	}
+	return nil
+}
+
+// Describe returns the remembered description of the network with the given ID.
+func Describe(id string) string {
+	file, err := common.ConfigPath(path.Join(NETWORKS_DIR, id, NETWORK_FILE))
+	if err != nil {
+		return id
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return id
+	}
+	return fmt.Sprintf("%s (%s)", id, strings.TrimSpace(string(data)))
+}
+
+// FindCache returns the config file name of the cache file name for the
+// network with the given ID. When that network has no cache yet, the most
+// recently written cache of another network is returned together with that
+// network's ID, so callers can warn that the data may not apply here.
+func FindCache(name, id string) (string, string, error) {
+	own := CacheFile(name, id)
+	if file, err := common.ConfigPath(own); err == nil {
+		if _, err := os.Stat(file); err == nil {
+			return own, id, nil
+		}
+	}
+
+	dir, err := common.ConfigPath(NETWORKS_DIR)
+	if err != nil {
+		return "", "", err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", "", &common.ConfigError{Op: "read", Path: dir, Err: err}
+	}
+	var newest string
+	var newestTime time.Time
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == id {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, entry.Name(), path.Base(name)))
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(newestTime) {
+			newest, newestTime = entry.Name(), info.ModTime()
+		}
+	}
+	if newest != "" {
+		return CacheFile(name, newest), newest, nil
+	}
+
+	// Caches written before fingerprinting existed are not tied to any network.
+	if file, err := common.ConfigPath(name); err == nil {
+		if _, err := os.Stat(file); err == nil {
+			return name, UNKNOWN_NETWORK, nil
+		}
+	}
+	return "", "", &common.ConfigError{Op: "read", Path: name, Err: os.ErrNotExist}
+}
+
+func publicPrefix(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ip
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return addr.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+func ipToInt(ip net.IP) *big.Int {
+	if v4 := ip.To4(); v4 != nil {
+		return new(big.Int).SetBytes(v4)
+	}
+	return new(big.Int).SetBytes(ip.To16())
+}
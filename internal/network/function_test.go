@@ -0,0 +1,114 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFingerprintID(t *testing.T) {
+	home := Fingerprint{Gateway: "192.168.1.1", GatewayMAC: "aa:bb:cc:dd:ee:ff", PublicIP: "5.1.2.3", ASN: "AS12880"}
+	rotated := home
+	rotated.PublicIP = "5.1.9.9"
+	office := home
+	office.GatewayMAC = "11:22:33:44:55:66"
+
+	assert.Equal(t, home.ID(), rotated.ID(), "public IP changes within an ASN must not change the network")
+	assert.NotEqual(t, home.ID(), office.ID(), "different routers must be different networks")
+	assert.Equal(t, UNKNOWN_NETWORK, Fingerprint{}.ID())
+
+	unknownMAC := home
+	unknownMAC.GatewayMAC = ""
+	assert.NotEqual(t, home.ID(), unknownMAC.ID())
+	assert.Equal(t, Fingerprint{Gateway: "192.168.1.1", ASN: "AS12880"}.ID(), unknownMAC.ID())
+	assert.NotEqual(t, unknownMAC.ID(), Fingerprint{ASN: "AS12880"}.ID(), "the gateway IP still tells networks apart")
+	assert.Len(t, home.ID(), 12)
+}
+
+func TestCurrent(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintln(w, "5.1.2.3")
+	}))
+	defer server.Close()
+	previous := EchoURL
+	EchoURL = server.URL
+	t.Cleanup(func() {
+		EchoURL = previous
+		current, currentKnown = Fingerprint{}, false
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Empty(t, Current(ctx).PublicIP, "an interrupted detection stops before the echo request")
+	assert.Equal(t, 0, requests)
+
+	assert.Equal(t, "5.1.2.3", Current(context.Background()).PublicIP, "an interrupted detection is not kept")
+	assert.Equal(t, "5.1.2.3", Current(context.Background()).PublicIP)
+	assert.Equal(t, 1, requests, "the network is detected once per run")
+}
+
+func TestLookupASN(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "ip2asn-v4.tsv")
+	content := "1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n" +
+		"5.0.0.0\t5.0.255.255\t0\tNone\tNot routed\n" +
+		"5.202.0.0\t5.202.255.255\t12880\tIR\tDCI-AS\n"
+	assert.NoError(t, os.WriteFile(db, []byte(content), 0644))
+
+	tests := []struct {
+		name    string
+		ip      string
+		asn     string
+		isp     string
+		wantErr bool
+	}{
+		{"First range", "1.0.0.1", "AS13335", "CLOUDFLARENET", false},
+		{"Last range", "5.202.100.100", "AS12880", "DCI-AS", false},
+		{"Not routed", "5.0.1.1", "", "", true},
+		{"Missing", "9.9.9.9", "", "", true},
+		{"Invalid IP", "not-an-ip", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			asn, isp, err := LookupASN(db, tt.ip)
+			assert.Equal(t, tt.wantErr, err != nil, "Test case: %s", tt.name)
+			assert.Equal(t, tt.asn, asn, "Test case: %s", tt.name)
+			assert.Equal(t, tt.isp, isp, "Test case: %s", tt.name)
+		})
+	}
+}
+
+func TestFindCache(t *testing.T) {
+	dir := t.TempDir()
+	previous := common.Config
+	common.Config = common.DirLocation(dir)
+	t.Cleanup(func() { common.Config = previous })
+
+	_, _, err := FindCache(common.CHECKED_DNS_CONFIG_FILE, "home")
+	assert.Error(t, err)
+
+	assert.NoError(t, common.WriteDNSToFile(CacheFile(common.CHECKED_DNS_CONFIG_FILE, "office"), []string{"10.202.10.202"}))
+	old := time.Now().Add(-time.Hour)
+	assert.NoError(t, os.Chtimes(filepath.Join(dir, "networks", "office", "checked_dns.conf"), old, old))
+	assert.NoError(t, common.WriteDNSToFile(CacheFile(common.CHECKED_DNS_CONFIG_FILE, "ci"), []string{"8.8.8.8"}))
+
+	file, cachedOn, err := FindCache(common.CHECKED_DNS_CONFIG_FILE, "home")
+	assert.NoError(t, err)
+	assert.Equal(t, "ci", cachedOn)
+	assert.Equal(t, CacheFile(common.CHECKED_DNS_CONFIG_FILE, "ci"), file)
+
+	file, cachedOn, err = FindCache(common.CHECKED_DNS_CONFIG_FILE, "office")
+	assert.NoError(t, err)
+	assert.Equal(t, "office", cachedOn)
+	assert.Equal(t, CacheFile(common.CHECKED_DNS_CONFIG_FILE, "office"), file)
+}
@@ -0,0 +1,59 @@
+package network
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"strings"
+)
+
+// DefaultGateway returns the IPv4 default gateway and its hardware address,
+// read from /proc/net/route and /proc/net/arp.
+func DefaultGateway() (string, string, error) {
+	file, err := os.Open("/proc/net/route")
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	var gateway string
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(raw))
+		gateway = ip.String()
+		break
+	}
+	if err := scanner.Err(); err != nil {
+		return "", "", err
+	}
+	if gateway == "" {
+		return "", "", os.ErrNotExist
+	}
+	return gateway, gatewayMAC(gateway), nil
+}
+
+func gatewayMAC(gateway string) string {
+	data, err := os.ReadFile("/proc/net/arp")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[0] == gateway {
+			return fields[3]
+		}
+	}
+	return ""
+}
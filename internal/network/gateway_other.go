@@ -0,0 +1,9 @@
+//go:build !linux
+
+package network
+
+// DefaultGateway is only implemented on Linux; elsewhere the fingerprint
+// relies on the public IP and ASN.
+func DefaultGateway() (string, string, error) {
+	return "", "", ErrUnsupported
+}
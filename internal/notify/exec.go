@@ -0,0 +1,62 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// This file and internal/docker/exec.go are the only places allowed to start
+// sub processes (see the depguard settings in .golangci.yml): hooks are user
+// supplied commands and desktop notifications have no portable API.
+
+// Command runs a shell command for every event. The event is passed in the
+// environment as UNLOCKER_EVENT, UNLOCKER_TARGET, UNLOCKER_PREVIOUS,
+// UNLOCKER_CURRENT and UNLOCKER_MESSAGE.
+type Command struct {
+	Command string
+}
+
+func (c Command) Notify(ctx context.Context, event Event) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", c.Command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", c.Command)
+	}
+	cmd.Env = append(os.Environ(),
+		"UNLOCKER_EVENT="+event.Kind,
+		"UNLOCKER_TARGET="+event.Target,
+		"UNLOCKER_PREVIOUS="+event.Previous,
+		"UNLOCKER_CURRENT="+event.Current,
+		"UNLOCKER_MESSAGE="+event.Message,
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("hook %q: %w", c.Command, err)
+	}
+	return nil
+}
+
+// Desktop shows events as desktop notifications using notify-send on Linux
+// and osascript on macOS.
+type Desktop struct{}
+
+func (Desktop) Notify(ctx context.Context, event Event) error {
+	const title = "403unlocker"
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux", "freebsd", "openbsd":
+		cmd = exec.CommandContext(ctx, "notify-send", title, event.Message)
+	case "darwin":
+		script := fmt.Sprintf("display notification %q with title %q", event.Message, title)
+		cmd = exec.CommandContext(ctx, "osascript", "-e", script)
+	default:
+		return fmt.Errorf("desktop notifications are not supported on %s", runtime.GOOS)
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("desktop notification: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookNotify(t *testing.T) {
+	received := make(chan Event, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event Event
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&event))
+		received <- event
+	}))
+	defer server.Close()
+
+	event := Event{Kind: EVENT_BEST_CHANGED, Target: "pkg.go.dev", Previous: "a", Current: "b"}
+	assert.NoError(t, Multi{Webhook{URL: server.URL}}.Notify(context.Background(), event))
+	got := <-received
+	assert.Equal(t, event.Kind, got.Kind)
+	assert.Equal(t, event.Current, got.Current)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	assert.ErrorContains(t, Webhook{URL: failing.URL}.Notify(context.Background(), event), "500")
+}
+
+func TestCommandNotify(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks run with sh")
+	}
+	out := filepath.Join(t.TempDir(), "event")
+	t.Setenv("UNLOCKER_TEST_OUT", out)
+	hook := Command{Command: `printf '%s\n' "$UNLOCKER_EVENT" "$UNLOCKER_TARGET" "$UNLOCKER_PREVIOUS" "$UNLOCKER_CURRENT" "$UNLOCKER_MESSAGE" > "$UNLOCKER_TEST_OUT"`}
+
+	// The event only reaches the command through the environment, so quotes
+	// and shell syntax in it are not interpreted.
+	event := Event{Kind: EVENT_ALL_FAILED, Target: "pkg.go.dev", Previous: "10.202.10.202", Message: `all "failed"; $(touch pwned)`}
+	assert.NoError(t, hook.Notify(context.Background(), event))
+	content, err := os.ReadFile(out)
+	assert.NoError(t, err)
+	assert.Equal(t, "all-failed\npkg.go.dev\n10.202.10.202\n\nall \"failed\"; $(touch pwned)\n", string(content))
+	assert.NoFileExists(t, "pwned")
+
+	err = Command{Command: "exit 3"}.Notify(context.Background(), event)
+	assert.ErrorContains(t, err, `hook "exit 3"`)
+}
@@ -0,0 +1,365 @@
+package profile
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+	"github.com/urfave/cli/v2"
+)
+
+// ErrUnknownProfile is returned when a profile that was never created is selected.
+var ErrUnknownProfile = errors.New("unknown profile")
+
+// NameValidator reports whether name can be used as a profile directory name.
+func NameValidator(name string) bool {
+	return regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,62}$`).MatchString(name)
+}
+
+// Active returns the profile selected with `config profile use`, falling back
+// to the default profile.
+func Active(base common.ConfigLocation) (string, error) {
+	path, err := base.Resolve(common.ACTIVE_PROFILE_FILE)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return common.DEFAULT_PROFILE, nil
+	}
+	if err != nil {
+		return "", &common.ConfigError{Op: "read", Path: path, Err: err}
+	}
+	name := strings.TrimSpace(string(data))
+	if name == "" {
+		return common.DEFAULT_PROFILE, nil
+	}
+	return name, nil
+}
+
+// Location returns the config location of the named profile, failing when
+// the profile does not exist.
+func Location(base common.ConfigLocation, name string) (common.ConfigLocation, error) {
+	loc := common.ProfileLocation{Base: base, Name: name}
+	if name == common.DEFAULT_PROFILE {
+		return loc, nil
+	}
+	dir, err := profileDir(base, name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return nil, &common.ConfigError{Op: "load profile", Path: name, Err: ErrUnknownProfile}
+	}
+	return loc, nil
+}
+
+// Selected returns the config location of the profile named, or when name is
+// empty of the profile bound to the current network, or else of the active
+// profile. networkID is only called when some profile is bound to a network.
+// A bound or active profile that was deleted falls back to the default
+// profile with a warning, so commands, including `config profile use`, keep
+// working.
+func Selected(base common.ConfigLocation, name string, networkID func() string) (common.ConfigLocation, error) {
+	if name != "" {
+		return Location(base, name)
+	}
+	bound, err := NetworkProfiles(base)
+	if err != nil {
+		return nil, err
+	}
+	if len(bound) > 0 {
+		if name, ok := bound[networkID()]; ok {
+			loc, err := Location(base, name)
+			if !errors.Is(err, ErrUnknownProfile) {
+				return loc, err
+			}
+			fmt.Fprintln(os.Stderr, common.Colorize(common.Yellow, fmt.Sprintf("Warning: the profile %q bound to this network does not exist, using the active profile.", name)))
+		}
+	}
+	name, err = Active(base)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := Location(base, name)
+	if errors.Is(err, ErrUnknownProfile) {
+		fmt.Fprintln(os.Stderr, common.Colorize(common.Yellow, fmt.Sprintf("Warning: the active profile %q does not exist, using the %s profile; select another with `config profile use`.", name, common.DEFAULT_PROFILE)))
+		return Location(base, common.DEFAULT_PROFILE)
+	}
+	return loc, err
+}
+
+// NetworkProfiles returns the profiles bound to networks with Bind, by
+// network ID.
+func NetworkProfiles(base common.ConfigLocation) (map[string]string, error) {
+	path, err := base.Resolve(common.NETWORK_PROFILES_FILE)
+	if err != nil {
+		return nil, err
+	}
+	return readPairs(path)
+}
+
+// Bind makes name the profile used on the network with the given ID, instead
+// of the active profile.
+func Bind(base common.ConfigLocation, networkID, name string) error {
+	if _, err := Location(base, name); err != nil {
+		return err
+	}
+	bound, err := NetworkProfiles(base)
+	if err != nil {
+		return err
+	}
+	bound[networkID] = name
+	path, err := base.Resolve(common.NETWORK_PROFILES_FILE)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return &common.ConfigError{Op: "create directory", Path: filepath.Dir(path), Err: err}
+	}
+	return writePairs(path, "# Profile used per network ID, see `config network`.", bound)
+}
+
+// List returns the names of all profiles, including the default one.
+func List(base common.ConfigLocation) ([]string, error) {
+	dir, err := base.Resolve(common.PROFILES_DIR)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{common.DEFAULT_PROFILE}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, &common.ConfigError{Op: "list profiles", Path: dir, Err: err}
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != common.DEFAULT_PROFILE {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names[1:])
+	return names, nil
+}
+
+// Create makes a new profile. The DNS and registry lists are copied from the
+// profile named from, or downloaded when it has none.
+func Create(base common.ConfigLocation, name, from string, defaults map[string]string) error {
+	if !NameValidator(name) || name == common.DEFAULT_PROFILE {
+		return fmt.Errorf("%w: invalid profile name %q", common.ErrInvalidInput, name)
+	}
+	dir, err := profileDir(base, name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return fmt.Errorf("%w: profile %q already exists", common.ErrInvalidInput, name)
+	}
+	source, err := Location(base, from)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return &common.ConfigError{Op: "create directory", Path: dir, Err: err}
+	}
+	target := common.ProfileLocation{Base: base, Name: name}
+
+	configs := map[string]string{
+		common.DNS_CONFIG_FILE:    common.DNS_CONFIG_URL,
+		common.DOCKER_CONFIG_FILE: common.DOCKER_CONFIG_URL,
+	}
+	for file, url := range configs {
+		if err := copyConfig(source, target, file, url); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+
+	return WriteDefaults(target, defaults)
+}
+
+// Use makes name the active profile.
+func Use(base common.ConfigLocation, name string) error {
+	if _, err := Location(base, name); err != nil {
+		return err
+	}
+	path, err := base.Resolve(common.ACTIVE_PROFILE_FILE)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return &common.ConfigError{Op: "create directory", Path: filepath.Dir(path), Err: err}
+	}
+	if err := os.WriteFile(path, []byte(name+"\n"), 0644); err != nil {
+		return &common.ConfigError{Op: "write", Path: path, Err: err}
+	}
+	return nil
+}
+
+// Defaults reads the key=value flag defaults of the profile at loc.
+func Defaults(loc common.ConfigLocation) (map[string]string, error) {
+	path, err := loc.Resolve(common.PROFILE_DEFAULTS_FILE)
+	if err != nil {
+		return nil, err
+	}
+	return readPairs(path)
+}
+
+// readPairs reads a file of key=value lines, ignoring blank lines and
+// comments. A missing file has no pairs.
+func readPairs(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, &common.ConfigError{Op: "read", Path: path, Err: err}
+	}
+	defer file.Close()
+
+	pairs := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, &common.ConfigError{Op: "parse", Path: path, Err: fmt.Errorf("expected key=value, got %q", line)}
+		}
+		pairs[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &common.ConfigError{Op: "read", Path: path, Err: err}
+	}
+	return pairs, nil
+}
+
+// WriteDefaults stores defaults as the flag defaults of the profile at loc.
+func WriteDefaults(loc common.ConfigLocation, defaults map[string]string) error {
+	path, err := loc.Resolve(common.PROFILE_DEFAULTS_FILE)
+	if err != nil {
+		return err
+	}
+	return writePairs(path, "# Flag defaults for this profile, one key=value per line.", defaults)
+}
+
+// writePairs writes pairs as key=value lines sorted by key, below header.
+func writePairs(path, header string, pairs map[string]string) error {
+	keys := make([]string, 0, len(pairs))
+	for key := range pairs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(header + "\n")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%s=%s\n", key, pairs[key])
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return &common.ConfigError{Op: "write", Path: path, Err: err}
+	}
+	return nil
+}
+
+// ParseDefaults turns key=value pairs given on the command line into a map.
+func ParseDefaults(pairs []string) (map[string]string, error) {
+	defaults := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("%w: invalid default %q, expected key=value", common.ErrInvalidInput, pair)
+		}
+		defaults[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return defaults, nil
+}
+
+// ValidateDefaults returns an ErrInvalidInput error when a default is not a
+// flag of any command of app, which is most likely a typo.
+func ValidateDefaults(app *cli.App, defaults map[string]string) error {
+	known := make(map[string]bool)
+	var collect func(commands []*cli.Command)
+	collect = func(commands []*cli.Command) {
+		for _, command := range commands {
+			for _, flag := range command.Flags {
+				for _, name := range flag.Names() {
+					known[name] = true
+				}
+			}
+			collect(command.Subcommands)
+		}
+	}
+	collect(app.Commands)
+
+	keys := make([]string, 0, len(defaults))
+	for key := range defaults {
+		if !known[key] {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) > 0 {
+		sort.Strings(keys)
+		return fmt.Errorf("%w: unknown profile default %s, not a flag of any command", common.ErrInvalidInput, strings.Join(keys, ", "))
+	}
+	return nil
+}
+
+// ApplyDefaults sets every flag of the running command that has a profile
+// default and was not given explicitly on the command line. Defaults that
+// are not a flag of any command are rejected, see ValidateDefaults.
+func ApplyDefaults(c *cli.Context, defaults map[string]string) error {
+	if err := ValidateDefaults(c.App, defaults); err != nil {
+		return err
+	}
+	for _, flag := range c.Command.Flags {
+		names := flag.Names()
+		if c.IsSet(names[0]) {
+			continue
+		}
+		for _, name := range names {
+			value, ok := defaults[name]
+			if !ok {
+				continue
+			}
+			if err := c.Set(names[0], value); err != nil {
+				return fmt.Errorf("invalid profile default %s=%s: %w", name, value, err)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+func profileDir(base common.ConfigLocation, name string) (string, error) {
+	if !NameValidator(name) {
+		return "", &common.ConfigError{Op: "load profile", Path: name, Err: ErrUnknownProfile}
+	}
+	return base.Resolve(path.Join(common.PROFILES_DIR, name))
+}
+
+func copyConfig(source, target common.ConfigLocation, file, url string) error {
+	from, err := source.Resolve(file)
+	if err != nil {
+		return err
+	}
+	to, err := target.Resolve(file)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(from)
+	if err != nil {
+		return common.DownloadFile(url, to)
+	}
+	if err := os.WriteFile(to, data, 0644); err != nil {
+		return &common.ConfigError{Op: "write", Path: to, Err: err}
+	}
+	return nil
+}
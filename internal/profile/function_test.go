@@ -0,0 +1,196 @@
+package profile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+func TestNameValidator(t *testing.T) {
+	tests := []struct {
+		name     string
+		profile  string
+		expected bool
+	}{
+		{"Simple name", "office", true},
+		{"Name with dash and digits", "ci-runner-2", true},
+		{"Empty name", "", false},
+		{"Path traversal", "../office", false},
+		{"Starts with dot", ".hidden", false},
+		{"Contains slash", "home/isp", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, NameValidator(tt.profile), "Test case: %s", tt.name)
+		})
+	}
+}
+
+func TestProfileLifecycle(t *testing.T) {
+	dir := t.TempDir()
+	base := common.DirLocation(dir)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "dns.conf"), []byte("1.1.1.1 8.8.8.8"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "dockerRegistry.conf"), []byte("focker.ir"), 0644))
+
+	active, err := Active(base)
+	assert.NoError(t, err)
+	assert.Equal(t, common.DEFAULT_PROFILE, active)
+
+	assert.NoError(t, Create(base, "office", common.DEFAULT_PROFILE, map[string]string{"timeout": "20"}))
+	assert.Error(t, Create(base, "office", common.DEFAULT_PROFILE, nil))
+	assert.Error(t, Use(base, "home"))
+	assert.NoError(t, Use(base, "office"))
+
+	active, err = Active(base)
+	assert.NoError(t, err)
+	assert.Equal(t, "office", active)
+
+	names, err := List(base)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{common.DEFAULT_PROFILE, "office"}, names)
+
+	loc, err := Location(base, "office")
+	assert.NoError(t, err)
+	path, err := loc.Resolve(common.DNS_CONFIG_FILE)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "profiles", "office", "dns.conf"), path)
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "1.1.1.1 8.8.8.8", string(data))
+
+	defaults, err := Defaults(loc)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"timeout": "20"}, defaults)
+}
+
+func TestSelectedDeletedProfile(t *testing.T) {
+	dir := t.TempDir()
+	base := common.DirLocation(dir)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "dns.conf"), []byte("1.1.1.1"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "dockerRegistry.conf"), []byte("focker.ir"), 0644))
+	assert.NoError(t, Create(base, "office", common.DEFAULT_PROFILE, nil))
+	assert.NoError(t, Use(base, "office"))
+
+	loc, err := Selected(base, "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, common.ProfileLocation{Base: base, Name: "office"}, loc)
+
+	assert.NoError(t, os.RemoveAll(filepath.Join(dir, "profiles", "office")))
+	loc, err = Selected(base, "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, common.ProfileLocation{Base: base, Name: common.DEFAULT_PROFILE}, loc)
+	_, err = Selected(base, "office", nil)
+	assert.ErrorIs(t, err, ErrUnknownProfile)
+	assert.NoError(t, Use(base, common.DEFAULT_PROFILE))
+}
+
+func TestSelectedByNetwork(t *testing.T) {
+	dir := t.TempDir()
+	base := common.DirLocation(dir)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "dns.conf"), []byte("1.1.1.1"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "dockerRegistry.conf"), []byte("focker.ir"), 0644))
+	assert.NoError(t, Create(base, "office", common.DEFAULT_PROFILE, nil))
+	assert.NoError(t, Create(base, "home", common.DEFAULT_PROFILE, nil))
+	assert.NoError(t, Use(base, "home"))
+	assert.Error(t, Bind(base, "7d7ae6a2561b", "cafe"))
+	assert.NoError(t, Bind(base, "7d7ae6a2561b", "office"))
+
+	bound, err := NetworkProfiles(base)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"7d7ae6a2561b": "office"}, bound)
+
+	networkID := "7d7ae6a2561b"
+	current := func() string { return networkID }
+	loc, err := Selected(base, "", current)
+	assert.NoError(t, err)
+	assert.Equal(t, common.ProfileLocation{Base: base, Name: "office"}, loc)
+
+	networkID = "000000000000"
+	loc, err = Selected(base, "", current)
+	assert.NoError(t, err)
+	assert.Equal(t, common.ProfileLocation{Base: base, Name: "home"}, loc, "other networks use the active profile")
+
+	networkID = "7d7ae6a2561b"
+	loc, err = Selected(base, common.DEFAULT_PROFILE, current)
+	assert.NoError(t, err)
+	assert.Equal(t, common.ProfileLocation{Base: base, Name: common.DEFAULT_PROFILE}, loc, "--profile wins")
+
+	assert.NoError(t, os.RemoveAll(filepath.Join(dir, "profiles", "office")))
+	loc, err = Selected(base, "", current)
+	assert.NoError(t, err)
+	assert.Equal(t, common.ProfileLocation{Base: base, Name: "home"}, loc)
+}
+
+func TestExitCode(t *testing.T) {
+	dir := t.TempDir()
+	base := common.DirLocation(dir)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "dns.conf"), []byte("1.1.1.1"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "dockerRegistry.conf"), []byte("focker.ir"), 0644))
+	assert.NoError(t, Create(base, "office", common.DEFAULT_PROFILE, nil))
+	_, parseErr := ParseDefaults([]string{"timeout"})
+
+	tests := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{"Invalid profile name", Create(base, "../office", common.DEFAULT_PROFILE, nil), common.EXIT_INVALID_INPUT},
+		{"Default profile name", Create(base, common.DEFAULT_PROFILE, common.DEFAULT_PROFILE, nil), common.EXIT_INVALID_INPUT},
+		{"Existing profile", Create(base, "office", common.DEFAULT_PROFILE, nil), common.EXIT_INVALID_INPUT},
+		{"Invalid --default", parseErr, common.EXIT_INVALID_INPUT},
+		{"Unknown profile", Use(base, "home"), common.EXIT_CONFIG_ERROR},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, common.ExitCode(tt.err), "Test case: %s", tt.name)
+		})
+	}
+}
+
+func TestParseDefaults(t *testing.T) {
+	defaults, err := ParseDefaults([]string{"timeout=15", " check = true "})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"timeout": "15", "check": "true"}, defaults)
+
+	_, err = ParseDefaults([]string{"timeout"})
+	assert.Error(t, err)
+}
+
+func TestApplyDefaults(t *testing.T) {
+	run := func(defaults map[string]string, args ...string) (int, error) {
+		var timeout int
+		app := &cli.App{
+			Commands: []*cli.Command{
+				{
+					Name:   "check",
+					Flags:  []cli.Flag{&cli.IntFlag{Name: "timeout", Aliases: []string{"t"}, Value: 10}},
+					Before: func(c *cli.Context) error { return ApplyDefaults(c, defaults) },
+					Action: func(c *cli.Context) error {
+						timeout = c.Int("timeout")
+						return nil
+					},
+				},
+				{Name: "docker", Flags: []cli.Flag{&cli.StringFlag{Name: "max-bytes"}}},
+			},
+		}
+		err := app.Run(append([]string{"403unlocker", "check"}, args...))
+		return timeout, err
+	}
+
+	timeout, err := run(map[string]string{"timeout": "20", "max-bytes": "50MB"})
+	assert.NoError(t, err)
+	assert.Equal(t, 20, timeout, "defaults of other commands are fine")
+
+	timeout, err = run(map[string]string{"timeout": "20"}, "--timeout", "5")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, timeout, "flags given explicitly win")
+
+	_, err = run(map[string]string{"timout": "20"})
+	assert.ErrorIs(t, err, common.ErrInvalidInput)
+}
@@ -0,0 +1,311 @@
+package tui
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/salehborhani/403Unlocker-cli/internal/check"
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+	"github.com/salehborhani/403Unlocker-cli/internal/dns"
+	"github.com/salehborhani/403Unlocker-cli/internal/history"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/term"
+)
+
+const DEFAULT_RESOLV_CONF = "/etc/resolv.conf"
+
+// ErrNotTerminal is returned when the TUI is started without an interactive terminal.
+var ErrNotTerminal = errors.New("tui needs an interactive terminal, use check or bestdns instead")
+
+// dashboard holds the state shared between the probe and the UI goroutines.
+type dashboard struct {
+	// url is downloaded, checkURL (its https://<host>/) is checked.
+	url        string
+	checkURL   string
+	dnsList    []string
+	timeout    time.Duration
+	timeouts   common.Timeouts
+	resolvConf string
+
+	mu      sync.Mutex
+	rows    map[string]*Row
+	sortKey string
+	running bool
+	message string
+}
+
+func (d *dashboard) view(width int) View {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	rows := make([]Row, 0, len(d.rows))
+	for _, row := range d.rows {
+		rows = append(rows, *row)
+	}
+	return View{
+		URL:     d.url,
+		Rows:    rows,
+		Sort:    d.sortKey,
+		Timeout: d.timeout,
+		Running: d.running,
+		Message: d.message,
+		Width:   width,
+	}
+}
+
+func (d *dashboard) update(server string, fn func(row *Row)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	fn(d.rows[server])
+}
+
+func (d *dashboard) setMessage(format string, args ...any) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.message = fmt.Sprintf(format, args...)
+}
+
+// start resets the rows and runs a new round in the background unless one is running.
+func (d *dashboard) start(ctx context.Context) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.running {
+		return false
+	}
+	d.running = true
+	d.rows = make(map[string]*Row, len(d.dnsList))
+	for _, server := range d.dnsList {
+		d.rows[server] = &Row{Server: server}
+	}
+	go d.run(ctx)
+	return true
+}
+
+// run checks the URL through every server concurrently, then measures the
+// download speed through each working server one after the other.
+func (d *dashboard) run(ctx context.Context) {
+	defer func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.running = false
+	}()
+
+	started := time.Now()
+	results := check.Probe(ctx, d.checkURL, d.dnsList, d.timeouts, func(result check.Result) {
+		d.update(result.Server, func(row *Row) {
+			row.Checked = true
+			row.OK = result.OK()
+			row.StatusCode = result.StatusCode
+			row.Status = result.Status
+			row.Latency = result.Latency
+		})
+	})
+	check.RecordHistory(ctx, history.KIND_CHECK, d.checkURL, started, results)
+
+	started = time.Now()
+	sizes := make(map[string]int64)
+	for _, result := range results {
+		if !result.OK() || ctx.Err() != nil {
+			continue
+		}
+		server := result.Server
+		d.update(server, func(row *Row) { row.Testing = true })
+
+		downloadStart := time.Now()
+		downloadCtx, cancel := context.WithTimeout(ctx, d.timeout)
+		size, err := dns.DownloadWithDNS(downloadCtx, server, d.url, common.DownloadOptions{}, func(bytes int64) {
+			d.update(server, func(row *Row) {
+				row.Bytes = bytes
+				row.Elapsed = time.Since(downloadStart)
+			})
+		})
+		cancel()
+		if err != nil {
+			d.setMessage("Error: %v", err)
+		}
+		sizes[server] = size
+		d.update(server, func(row *Row) {
+			row.Testing = false
+			row.Tested = true
+			row.Bytes = size
+			row.Elapsed = min(time.Since(downloadStart), d.timeout)
+		})
+	}
+	if len(sizes) > 0 {
+		dns.RecordBenchmark(ctx, d.url, started, d.timeout, sizes)
+	}
+}
+
+// best returns the current best server.
+func (d *dashboard) best() string {
+	return Best(d.view(0).Rows)
+}
+
+// Run shows a live dashboard of the URL in the first argument through every
+// configured DNS server until the user quits.
+func Run(c *cli.Context) error {
+	in, out := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+	if !term.IsTerminal(in) || !term.IsTerminal(out) {
+		return ErrNotTerminal
+	}
+
+	dnsList, err := common.ReadOrDownloadConfig(common.DNS_CONFIG_FILE, common.DNS_CONFIG_URL)
+	if err != nil {
+		return err
+	}
+	url := c.Args().First()
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		url = "https://" + url
+	}
+	d := &dashboard{
+		url:        url,
+		checkURL:   check.EnsureHTTPS(url),
+		dnsList:    dnsList,
+		timeout:    time.Duration(c.Int("timeout")) * time.Second,
+		timeouts:   check.TimeoutsFlag(c, "check-timeout"),
+		resolvConf: c.String("resolv-conf"),
+		sortKey:    SORT_STATUS,
+	}
+
+	oldState, err := term.MakeRaw(in)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(in, oldState)
+	// Switch to the alternate screen and hide the cursor until we quit.
+	fmt.Print("\033[?1049h\033[?25l")
+	defer fmt.Print("\033[?25h\033[?1049l")
+
+	ctx, cancel := context.WithCancel(c.Context)
+	defer cancel()
+
+	keys := make(chan byte)
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := os.Stdin.Read(buf); err != nil {
+				close(keys)
+				return
+			}
+			keys <- buf[0]
+		}
+	}()
+
+	d.start(ctx)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		draw(d, out)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case key, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			switch key {
+			case 'q', 'Q', 3, 4: // Ctrl-C and Ctrl-D as well, the terminal is in raw mode
+				return nil
+			case 'r', 'R':
+				if d.start(ctx) {
+					d.setMessage("Re-running")
+				} else {
+					d.setMessage("A round is still running")
+				}
+			case 's', 'S':
+				d.mu.Lock()
+				d.sortKey = NextSort(d.sortKey)
+				d.mu.Unlock()
+			case 'c', 'C':
+				if best := d.best(); best != "" {
+					copyToClipboard(best)
+					d.setMessage("Copied %s to the clipboard", best)
+				} else {
+					d.setMessage("No working server yet")
+				}
+			case 'a', 'A':
+				if best := d.best(); best != "" {
+					if err := ApplyDNS(d.resolvConf, best); err != nil {
+						d.setMessage("Error: %v", err)
+					} else {
+						d.setMessage("Wrote nameserver %s to %s (backup in %s)", best, d.resolvConf, d.resolvConf+".403unlocker.bak")
+					}
+				} else {
+					d.setMessage("No working server yet")
+				}
+			}
+		}
+	}
+}
+
+func draw(d *dashboard, out int) {
+	width, height, err := term.GetSize(out)
+	if err != nil {
+		width, height = 80, 24
+	}
+	lines := Render(d.view(width))
+	if len(lines) > height {
+		lines = lines[:height]
+	}
+	var b strings.Builder
+	b.WriteString("\033[H")
+	for _, line := range lines {
+		// The terminal is in raw mode, so every line needs an explicit carriage return.
+		b.WriteString(line)
+		b.WriteString("\033[K\r\n")
+	}
+	b.WriteString("\033[J")
+	fmt.Print(b.String())
+}
+
+// copyToClipboard asks the terminal to put text on the clipboard with an
+// OSC 52 escape, which also works over SSH.
+func copyToClipboard(text string) {
+	fmt.Printf("\033]52;c;%s\a", base64.StdEncoding.EncodeToString([]byte(text)))
+}
+
+// resolvHeader marks resolv.conf files written by ApplyDNS.
+const resolvHeader = "# Written by 403unlocker"
+
+// ApplyDNS makes server the only nameserver in path and keeps its other
+// lines, such as search and options. The original file is backed up to
+// path.403unlocker.bak the first time; later calls keep that backup. Symlinks,
+// like the resolv.conf of systemd-resolved, are refused, since the file
+// behind them is managed by another service.
+func ApplyDNS(path, server string) error {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		target, _ := os.Readlink(path)
+		return fmt.Errorf("%s is a symlink to %s, set the DNS server in the service managing it", path, target)
+	}
+	current, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		backup := path + ".403unlocker.bak"
+		if _, err := os.Stat(backup); os.IsNotExist(err) {
+			if err := os.WriteFile(backup, current, 0o644); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\nnameserver %s\n", resolvHeader, server)
+	for _, line := range strings.Split(string(current), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] == "nameserver" || line == resolvHeader {
+			continue
+		}
+		b.WriteString(line + "\n")
+	}
+	return os.WriteFile(path, []byte(b.String()), 0o644)
+}
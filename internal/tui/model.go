@@ -0,0 +1,226 @@
+package tui
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+)
+
+// Columns the rows can be sorted by.
+const (
+	SORT_STATUS  = "status"
+	SORT_LATENCY = "latency"
+	SORT_SPEED   = "speed"
+)
+
+var sortKeys = []string{SORT_STATUS, SORT_LATENCY, SORT_SPEED}
+
+// Row is the live state of one DNS server.
+type Row struct {
+	Server string
+
+	// Set once the check request through the server finished.
+	Checked    bool
+	OK         bool
+	StatusCode int
+	Status     string
+	Latency    time.Duration
+
+	// Set while and after the speed test through the server ran.
+	Testing bool
+	Tested  bool
+	Bytes   int64
+	Elapsed time.Duration
+}
+
+// Speed returns the download speed of the row in bytes per second.
+func (r Row) Speed() int64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return int64(float64(r.Bytes) / r.Elapsed.Seconds())
+}
+
+func (r Row) rank() int {
+	switch {
+	case r.OK:
+		return 0
+	case r.Checked && r.StatusCode != 0:
+		return 1
+	case r.Checked:
+		return 2
+	}
+	return 3
+}
+
+// NextSort returns the sort key after key, wrapping around.
+func NextSort(key string) string {
+	for i, k := range sortKeys {
+		if k == key {
+			return sortKeys[(i+1)%len(sortKeys)]
+		}
+	}
+	return SORT_STATUS
+}
+
+// Sort orders rows by key. Working servers come first for status, the
+// fastest answers for latency and the highest throughput for speed. Ties are
+// broken by server address so rows do not jump around between redraws.
+func Sort(rows []Row, key string) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		switch key {
+		case SORT_LATENCY:
+			if a.Checked != b.Checked {
+				return a.Checked
+			}
+			if a.Latency != b.Latency {
+				return a.Latency < b.Latency
+			}
+		case SORT_SPEED:
+			if a.Speed() != b.Speed() {
+				return a.Speed() > b.Speed()
+			}
+			if a.rank() != b.rank() {
+				return a.rank() < b.rank()
+			}
+		default:
+			if a.rank() != b.rank() {
+				return a.rank() < b.rank()
+			}
+			if a.Latency != b.Latency {
+				return a.Latency < b.Latency
+			}
+		}
+		return a.Server < b.Server
+	})
+}
+
+// Best returns the server with the highest download speed or, before any
+// speed test finished, the working server with the lowest latency.
+func Best(rows []Row) string {
+	best := ""
+	var bestSpeed int64
+	for _, row := range rows {
+		if row.Tested && row.Speed() > bestSpeed {
+			best, bestSpeed = row.Server, row.Speed()
+		}
+	}
+	if best != "" {
+		return best
+	}
+	var fastest time.Duration
+	for _, row := range rows {
+		if row.OK && (best == "" || row.Latency < fastest) {
+			best, fastest = row.Server, row.Latency
+		}
+	}
+	return best
+}
+
+// ProgressBar renders fraction (0 to 1) as a bar of width characters.
+func ProgressBar(fraction float64, width int) string {
+	if width <= 0 {
+		return ""
+	}
+	fraction = min(max(fraction, 0), 1)
+	filled := int(fraction * float64(width))
+	return strings.Repeat("█", filled) + strings.Repeat("░", width-filled)
+}
+
+// View is everything shown on one frame.
+type View struct {
+	URL     string
+	Rows    []Row
+	Sort    string
+	Timeout time.Duration
+	Running bool
+	Message string
+	Width   int
+}
+
+// Render returns the lines of the frame, without line endings.
+func Render(v View) []string {
+	rows := append([]Row(nil), v.Rows...)
+	Sort(rows, v.Sort)
+	best := Best(rows)
+
+	checked, working, serverWidth := 0, 0, len("DNS Server")
+	for _, row := range rows {
+		serverWidth = max(serverWidth, len(row.Server))
+		if row.Checked {
+			checked++
+		}
+		if row.OK {
+			working++
+		}
+	}
+	state := "done"
+	if v.Running {
+		state = "running"
+	}
+
+	lines := []string{
+		fmt.Sprintf("403unlocker  %s", v.URL),
+		fmt.Sprintf("Checked %d/%d, working %d, best %s  [%s]", checked, len(rows), working, orDash(best), state),
+		"",
+		fmt.Sprintf("  %-*s %-16s %9s %12s  %s", serverWidth, "DNS Server", header("Status", SORT_STATUS, v.Sort), header("Latency", SORT_LATENCY, v.Sort), header("Speed", SORT_SPEED, v.Sort), "Progress"),
+	}
+	barWidth := max(v.Width-serverWidth-48, 10)
+	for _, row := range rows {
+		marker := " "
+		if row.Server == best {
+			marker = "*"
+		}
+		color, status := common.Yellow, "..."
+		if row.Checked {
+			status = row.Status
+			color = common.Red
+			if row.OK {
+				color = common.Green
+			}
+		}
+		latency, speed, progress := "-", "-", ""
+		if row.Checked {
+			latency = row.Latency.Round(time.Millisecond).String()
+		}
+		if row.Testing || row.Tested {
+			speed = common.FormatDataSize(row.Speed()) + "/s"
+			fraction := 1.0
+			if row.Testing && v.Timeout > 0 {
+				fraction = float64(row.Elapsed) / float64(v.Timeout)
+			}
+			progress = ProgressBar(fraction, barWidth)
+		}
+		lines = append(lines, fmt.Sprintf("%s %-*s %s %9s %12s  %s", marker, serverWidth, row.Server, common.Colorize(color, fmt.Sprintf("%-16s", truncate(status, 16))), latency, speed, progress))
+	}
+	lines = append(lines, "",
+		"q quit  r re-run  s sort  c copy best  a apply best",
+		v.Message,
+	)
+	return lines
+}
+
+func header(name, key, current string) string {
+	if key == current {
+		return name + "▼"
+	}
+	return name
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-1] + "…"
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
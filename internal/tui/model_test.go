@@ -0,0 +1,107 @@
+package tui
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testRows() []Row {
+	return []Row{
+		{Server: "10.0.0.1", Checked: true, StatusCode: 403, Status: "Forbidden", Latency: 50 * time.Millisecond},
+		{Server: "10.0.0.2", Checked: true, OK: true, StatusCode: 200, Status: "OK", Latency: 300 * time.Millisecond, Tested: true, Bytes: 4000, Elapsed: time.Second},
+		{Server: "10.0.0.3"},
+		{Server: "10.0.0.4", Checked: true, OK: true, StatusCode: 200, Status: "OK", Latency: 100 * time.Millisecond, Tested: true, Bytes: 2000, Elapsed: time.Second},
+		{Server: "10.0.0.5", Checked: true, Status: "Error", Latency: 10 * time.Millisecond},
+	}
+}
+
+func servers(rows []Row) []string {
+	result := make([]string, 0, len(rows))
+	for _, row := range rows {
+		result = append(result, row.Server)
+	}
+	return result
+}
+
+func TestSort(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected []string
+	}{
+		{SORT_STATUS, []string{"10.0.0.4", "10.0.0.2", "10.0.0.1", "10.0.0.5", "10.0.0.3"}},
+		{SORT_LATENCY, []string{"10.0.0.5", "10.0.0.1", "10.0.0.4", "10.0.0.2", "10.0.0.3"}},
+		{SORT_SPEED, []string{"10.0.0.2", "10.0.0.4", "10.0.0.1", "10.0.0.5", "10.0.0.3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			rows := testRows()
+			Sort(rows, tt.key)
+			assert.Equal(t, tt.expected, servers(rows))
+		})
+	}
+}
+
+func TestBest(t *testing.T) {
+	rows := testRows()
+	assert.Equal(t, "10.0.0.2", Best(rows), "highest speed wins once tested")
+
+	for i := range rows {
+		rows[i].Tested = false
+	}
+	assert.Equal(t, "10.0.0.4", Best(rows), "lowest latency of the working servers before speed tests")
+
+	assert.Equal(t, "", Best([]Row{{Server: "10.0.0.3"}}))
+}
+
+func TestNextSort(t *testing.T) {
+	assert.Equal(t, SORT_LATENCY, NextSort(SORT_STATUS))
+	assert.Equal(t, SORT_SPEED, NextSort(SORT_LATENCY))
+	assert.Equal(t, SORT_STATUS, NextSort(SORT_SPEED))
+}
+
+func TestProgressBar(t *testing.T) {
+	assert.Equal(t, "█████░░░░░", ProgressBar(0.5, 10))
+	assert.Equal(t, "░░░░", ProgressBar(-1, 4))
+	assert.Equal(t, "████", ProgressBar(2, 4))
+	assert.Equal(t, "", ProgressBar(0.5, 0))
+}
+
+func TestRenderMarksBest(t *testing.T) {
+	lines := Render(View{URL: "https://pkg.go.dev", Rows: testRows(), Sort: SORT_SPEED, Width: 80})
+	assert.Contains(t, lines[1], "working 2, best 10.0.0.2")
+	assert.True(t, strings.HasPrefix(lines[4], "* 10.0.0.2"), lines[4])
+	assert.Contains(t, lines[3], "Speed▼")
+}
+
+func TestApplyDNS(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "resolv.conf")
+	original := "search corp.example.com\nnameserver 1.1.1.1\nnameserver 8.8.8.8\noptions edns0\n"
+	assert.NoError(t, os.WriteFile(path, []byte(original), 0o644))
+
+	assert.NoError(t, ApplyDNS(path, "10.202.10.202"))
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "# Written by 403unlocker\nnameserver 10.202.10.202\nsearch corp.example.com\noptions edns0\n", string(content))
+
+	// Applying again keeps the backup of the original file.
+	assert.NoError(t, ApplyDNS(path, "178.22.122.100"))
+	content, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "# Written by 403unlocker\nnameserver 178.22.122.100\nsearch corp.example.com\noptions edns0\n", string(content))
+	backup, err := os.ReadFile(path + ".403unlocker.bak")
+	assert.NoError(t, err)
+	assert.Equal(t, original, string(backup))
+
+	link := filepath.Join(dir, "stub-resolv.conf")
+	assert.NoError(t, os.Symlink(path, link))
+	assert.ErrorContains(t, ApplyDNS(link, "10.202.10.202"), "symlink")
+	content, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "178.22.122.100")
+}
@@ -1,73 +1,393 @@
 package unlockercli
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/salehborhani/403Unlocker-cli/internal/api"
 	"github.com/salehborhani/403Unlocker-cli/internal/check"
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
 	"github.com/salehborhani/403Unlocker-cli/internal/dns"
 	"github.com/salehborhani/403Unlocker-cli/internal/docker"
+	"github.com/salehborhani/403Unlocker-cli/internal/history"
+	"github.com/salehborhani/403Unlocker-cli/internal/metrics"
+	"github.com/salehborhani/403Unlocker-cli/internal/mirror"
+	"github.com/salehborhani/403Unlocker-cli/internal/network"
+	"github.com/salehborhani/403Unlocker-cli/internal/profile"
+	"github.com/salehborhani/403Unlocker-cli/internal/tui"
+	"github.com/salehborhani/403Unlocker-cli/internal/watch"
 	"github.com/urfave/cli/v2"
 )
 
 func Run() {
+	// baseConfig is the config directory without any profile applied.
+	var baseConfig common.ConfigLocation = common.HomeLocation{}
+
+	applyProfileDefaults := func(cCtx *cli.Context) error {
+		defaults, err := profile.Defaults(common.Config)
+		if err != nil {
+			return err
+		}
+		return profile.ApplyDefaults(cCtx, defaults)
+	}
+
+	fastdockerFlags := []cli.Flag{
+		&cli.IntFlag{
+			Name:    "timeout",
+			Usage:   "Sets timeout",
+			Value:   10,
+			Aliases: []string{"t"},
+		},
+		&cli.BoolFlag{
+			Name:  "fail-if-none",
+			Usage: "Exit with code 2 when no registry can serve the image",
+		},
+		&cli.StringFlag{
+			Name:  "keep",
+			Usage: "Save the layer downloaded from each registry in `DIR`/<registry>/ instead of discarding it",
+		},
+		&cli.StringFlag{
+			Name:  "max-bytes",
+			Usage: "Stop each download after this much data, e.g. 50MB; the speed is measured over the shorter time",
+		},
+		&cli.StringFlag{
+			Name:  "platform",
+			Usage: "Platform of the image to measure, e.g. linux/arm64 (default: linux on this machine's architecture)",
+		},
+		&cli.StringFlag{
+			Name:  "digest",
+			Usage: "Manifest digest every registry must serve the image with, instead of asking the reference registry",
+		},
+		&cli.StringFlag{
+			Name:  "reference",
+			Usage: "Trusted registry to read the image's digest from (default: the image's own registry)",
+		},
+	}
+	validateFastdocker := func(cCtx *cli.Context) error {
+		if !docker.DockerImageValidator(cCtx.Args().First()) {
+			return usageError(cCtx, "invalid docker image %q", cCtx.Args().First())
+		}
+		if cCtx.Int("timeout") <= 0 {
+			return usageError(cCtx, "timeout must be positive")
+		}
+		if _, err := common.ParseDataSize(cCtx.String("max-bytes")); err != nil {
+			return usageError(cCtx, "--max-bytes: %v", err)
+		}
+		if digest := cCtx.String("digest"); digest != "" {
+			if _, err := v1.NewHash(digest); err != nil {
+				return usageError(cCtx, "--digest: %v", err)
+			}
+		}
+		if platform := cCtx.String("platform"); platform != "" {
+			if _, err := v1.ParsePlatform(platform); err != nil {
+				return usageError(cCtx, "--platform: %v", err)
+			}
+		}
+		return nil
+	}
+
+	// probeTimeoutFlags limit the requests made through each DNS server to
+	// check a URL. The request timeout is called --timeout by check and
+	// --check-timeout by the commands whose --timeout is a download time.
+	probeTimeoutFlags := func(request string, aliases ...string) []cli.Flag {
+		return []cli.Flag{
+			&cli.IntFlag{
+				Name:    request,
+				Usage:   "Maximum time in seconds for the whole request through each DNS server when checking the URL",
+				Value:   int(common.DefaultTimeouts.Request / time.Second),
+				Aliases: aliases,
+			},
+			&cli.IntFlag{
+				Name:  "dial-timeout",
+				Usage: "Maximum time in seconds to resolve and connect to the URL's host when checking it",
+				Value: int(common.DefaultTimeouts.Dial / time.Second),
+			},
+			&cli.IntFlag{
+				Name:  "dns-timeout",
+				Usage: "Maximum time in seconds for each query to the DNS server when checking the URL",
+				Value: int(common.DefaultTimeouts.DNS / time.Second),
+			},
+		}
+	}
+	validateProbeTimeouts := func(cCtx *cli.Context, request string) error {
+		if cCtx.Int(request) < 0 || cCtx.Int("dial-timeout") < 0 || cCtx.Int("dns-timeout") < 0 {
+			return usageError(cCtx, "timeouts must not be negative (0 disables a limit)")
+		}
+		return nil
+	}
+
 	app := &cli.App{
 		EnableBashCompletion: true,
 		Name:                 "403unlocker",
 		Usage:                "403Unlocker-CLI is a versatile command-line tool designed to bypass 403 restrictions effectively",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "config-dir",
+				Usage:   "Directory holding dns.conf and dockerRegistry.conf (default: $HOME/.config/403unlocker)",
+				EnvVars: []string{"UNLOCKER_CONFIG_DIR"},
+			},
+			&cli.StringFlag{
+				Name:    "profile",
+				Usage:   "Use the DNS list, registry list, cache and defaults of the named profile",
+				EnvVars: []string{"UNLOCKER_PROFILE"},
+				Aliases: []string{"p"},
+			},
+			&cli.StringFlag{
+				Name:    "echo-url",
+				Usage:   "Endpoint returning the public IP, used to fingerprint the network (empty disables the lookup)",
+				Value:   network.DEFAULT_ECHO_URL,
+				EnvVars: []string{"UNLOCKER_ECHO_URL"},
+			},
+			&cli.StringFlag{
+				Name:    "asn-db",
+				Usage:   "ip2asn TSV database used to find the ISP of the public IP",
+				EnvVars: []string{"UNLOCKER_ASN_DB"},
+			},
+			&cli.BoolFlag{
+				Name:  "no-color",
+				Usage: "Do not color the output (colors are also off when NO_COLOR is set or stdout is not a terminal)",
+			},
+			&cli.BoolFlag{
+				Name:    "no-history",
+				Usage:   "Do not record results in the history database",
+				EnvVars: []string{"UNLOCKER_NO_HISTORY"},
+			},
+		},
+		Before: func(cCtx *cli.Context) error {
+			common.SetupColor(cCtx.Bool("no-color"))
+			if dir := cCtx.String("config-dir"); dir != "" {
+				baseConfig = common.DirLocation(dir)
+			}
+			network.EchoURL = cCtx.String("echo-url")
+			if db := cCtx.String("asn-db"); db != "" {
+				network.ASNDatabase = db
+			}
+
+			// A profile bound to the network is found with the ASN database
+			// of the default profile.
+			common.Config = baseConfig
+			loc, err := profile.Selected(baseConfig, cCtx.String("profile"), func() string {
+				return network.Current(cCtx.Context).ID()
+			})
+			if err != nil {
+				return err
+			}
+			common.Config = loc
+
+			history.Disabled = cCtx.Bool("no-history")
+			return nil
+		},
 		Commands: []*cli.Command{
 			{
 				Name:    "check",
 				Aliases: []string{"c"},
 				Usage:   "Checks if the DNS SNI-Proxy can bypass 403 error for a specific domain",
+				Before:  applyProfileDefaults,
 				Description: `Examples:
     403unlocker check https://pkg.go.dev`,
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{
+						Name:  "fail-if-none",
+						Usage: "Exit with code 2 when no DNS server can reach the URL",
+					},
+				}, probeTimeoutFlags("timeout", "t")...),
 				Action: func(cCtx *cli.Context) error {
-					if check.DomainValidator(cCtx.Args().First()) {
-						return check.CheckWithDNS(cCtx)
-					} else {
-						err := cli.ShowSubcommandHelp(cCtx)
-						if err != nil {
-							fmt.Println(err)
-						}
+					if !check.DomainValidator(cCtx.Args().First()) {
+						return usageError(cCtx, "invalid URL %q", cCtx.Args().First())
+					}
+					if err := validateProbeTimeouts(cCtx, "timeout"); err != nil {
+						return err
 					}
-					return nil
+					return check.CheckWithDNS(cCtx)
 				},
 			},
 			{
 				Name:    "fastdocker",
 				Aliases: []string{"docker"},
 				Usage:   "Finds the fastest docker registries for a specific docker image",
+				Before:  applyProfileDefaults,
 				Description: `Examples:
-    403unlocker fastdocker --timeout 15 gitlab/gitlab-ce:17.0.0-ce.0`,
-				Flags: []cli.Flag{
-					&cli.IntFlag{
-						Name:    "timeout",
-						Usage:   "Sets timeout",
-						Value:   10,
-						Aliases: []string{"t"},
-					},
-				},
+    403unlocker fastdocker --timeout 15 gitlab/gitlab-ce:17.0.0-ce.0
+    403unlocker fastdocker --platform linux/arm64 alpine:3.20
+    403unlocker fastdocker --reference docker.arvancloud.ir nginx:1.27`,
+				Flags: fastdockerFlags,
 				Action: func(cCtx *cli.Context) error {
-					if docker.DockerImageValidator(cCtx.Args().First()) {
-						return docker.CheckWithDockerImage(cCtx)
-					} else {
-						err := cli.ShowSubcommandHelp(cCtx)
-						if err != nil {
-							fmt.Println(err)
-						}
+					if err := validateFastdocker(cCtx); err != nil {
+						return err
 					}
-					return nil
+					return docker.CheckWithDockerImage(cCtx)
+				},
+				Subcommands: []*cli.Command{
+					{
+						Name:      "export",
+						Usage:     "Ranks the registries and writes the best ones as podman, containerd and BuildKit mirror configs",
+						ArgsUsage: "<image>",
+						Before:    applyProfileDefaults,
+						Description: `Files are written below --root for review, mirroring their place in /:
+    etc/containers/registries.conf
+    etc/containerd/certs.d/<registry>/hosts.toml
+    etc/buildkit/buildkitd.toml
+
+Examples:
+    403unlocker fastdocker export alpine:3.20
+    403unlocker fastdocker export --format containerd --top 2 --root /tmp/mirrors ghcr.io/owner/image:1`,
+						Flags: append([]cli.Flag{
+							&cli.StringFlag{
+								Name:  "root",
+								Usage: "Directory to write the configs below",
+								Value: docker.DEFAULT_EXPORT_ROOT,
+							},
+							&cli.StringSliceFlag{
+								Name:  "format",
+								Usage: "Configs to write: " + strings.Join(docker.EXPORT_FORMATS, ", "),
+								Value: cli.NewStringSlice(docker.EXPORT_FORMATS...),
+							},
+							&cli.IntFlag{
+								Name:  "top",
+								Usage: "Number of the fastest registries to list as mirrors, 0 for all that worked",
+								Value: 3,
+							},
+						}, fastdockerFlags...),
+						Action: func(cCtx *cli.Context) error {
+							if err := validateFastdocker(cCtx); err != nil {
+								return err
+							}
+							for _, format := range cCtx.StringSlice("format") {
+								if !slices.Contains(docker.EXPORT_FORMATS, format) {
+									return usageError(cCtx, "unknown --format %q", format)
+								}
+							}
+							if cCtx.Int("top") < 0 {
+								return usageError(cCtx, "--top must not be negative")
+							}
+							return docker.ExportWithDockerImage(cCtx)
+						},
+					},
+					{
+						Name:      "scan",
+						Usage:     "Reports for every image in Docker Compose files or Kubernetes manifests which registries serve it and which is fastest",
+						ArgsUsage: "<file|dir>",
+						Before:    applyProfileDefaults,
+						Description: `Every "image" field of the YAML file, or of the .yml and .yaml files below the
+directory, is pulled from every registry like fastdocker does, by the digest
+on the image's own registry or --reference. Variables like ${TAG:-latest} are
+taken from the environment.
+
+Examples:
+    403unlocker fastdocker scan docker-compose.yml
+    403unlocker fastdocker scan --fail-if-none --max-bytes 20MB deploy/k8s`,
+						Flags: []cli.Flag{
+							&cli.IntFlag{
+								Name:    "timeout",
+								Usage:   "Sets timeout for each image on each registry",
+								Value:   10,
+								Aliases: []string{"t"},
+							},
+							&cli.BoolFlag{
+								Name:  "fail-if-none",
+								Usage: "Exit with code 2 when no registry can serve one of the images",
+							},
+							&cli.StringFlag{
+								Name:  "max-bytes",
+								Usage: "Stop each download after this much data, e.g. 50MB; the speed is measured over the shorter time",
+							},
+							&cli.StringFlag{
+								Name:  "platform",
+								Usage: "Platform of the images to measure, e.g. linux/arm64 (default: linux on this machine's architecture)",
+							},
+							&cli.StringFlag{
+								Name:  "reference",
+								Usage: "Trusted registry to read each image's digest from (default: the image's own registry)",
+							},
+						},
+						Action: func(cCtx *cli.Context) error {
+							if cCtx.Args().First() == "" {
+								return usageError(cCtx, "a Docker Compose file, Kubernetes manifest or directory is required")
+							}
+							if cCtx.Int("timeout") <= 0 {
+								return usageError(cCtx, "timeout must be positive")
+							}
+							if _, err := common.ParseDataSize(cCtx.String("max-bytes")); err != nil {
+								return usageError(cCtx, "--max-bytes: %v", err)
+							}
+							if platform := cCtx.String("platform"); platform != "" {
+								if _, err := v1.ParsePlatform(platform); err != nil {
+									return usageError(cCtx, "--platform: %v", err)
+								}
+							}
+							return docker.ScanWithDockerImage(cCtx)
+						},
+					},
+				},
+			},
+			{
+				Name:  "registry",
+				Usage: "Inspects what the docker registries serve",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "inspect",
+						Usage:     "Reports per registry whether the image tag exists and is current, its platforms and the namespaces proxied",
+						ArgsUsage: "<image>",
+						Description: `The tag on each registry is compared with the digest on the image's own
+registry (Docker Hub unless the image names another one), --reference or --digest.
+A registry proxies ghcr.io, quay.io or gcr.io when it serves a known image of
+that registry under <registry>/ghcr.io/... (or the path set with map= in
+dockerRegistry.conf).
+
+Examples:
+    403unlocker registry inspect nginx:1.27
+    403unlocker registry inspect --digest sha256:0123... alpine:3.20`,
+						Before: applyProfileDefaults,
+						Flags: []cli.Flag{
+							&cli.IntFlag{
+								Name:    "timeout",
+								Usage:   "Maximum time in seconds to inspect each registry",
+								Value:   10,
+								Aliases: []string{"t"},
+							},
+							&cli.StringFlag{
+								Name:  "reference",
+								Usage: "Registry holding the up to date tag, e.g. a mirror you trust when the upstream registry is blocked",
+							},
+							&cli.StringFlag{
+								Name:  "digest",
+								Usage: "Expected manifest digest of the tag, instead of asking the reference registry",
+							},
+						},
+						Action: func(cCtx *cli.Context) error {
+							if !docker.DockerImageValidator(cCtx.Args().First()) {
+								return usageError(cCtx, "invalid docker image %q", cCtx.Args().First())
+							}
+							if cCtx.Int("timeout") <= 0 {
+								return usageError(cCtx, "timeout must be positive")
+							}
+							if digest := cCtx.String("digest"); digest != "" {
+								if _, err := v1.NewHash(digest); err != nil {
+									return usageError(cCtx, "--digest: %v", err)
+								}
+							}
+							return docker.InspectWithDockerImage(cCtx)
+						},
+					},
 				},
 			},
 			{
 				Name:    "bestdns",
 				Aliases: []string{"dns"},
 				Usage:   "Finds the fastest DNS SNI-Proxy for downloading a specific URL",
+				Before:  applyProfileDefaults,
 				Description: `Examples:
 			403unlocker bestdns --timeout 15 https://packages.gitlab.com/gitlab/gitlab-ce/packages/el/7/gitlab-ce-16.8.0-ce.0.el7.x86_64.rpm/download.rpm`,
-				Flags: []cli.Flag{
+				Flags: append([]cli.Flag{
 					&cli.IntFlag{
 						Name:    "timeout",
 						Usage:   "Sets timeout in seconds",
@@ -76,31 +396,549 @@ func Run() {
 					},
 					&cli.BoolFlag{
 						Name:    "check",
-						Usage:   "Update the DNS cache before running the check",
+						Usage:   "Only benchmark DNS servers from the checked DNS cache, refreshing it when expired or built for another domain",
 						Aliases: []string{"c"},
 					},
-				},
+					&cli.DurationFlag{
+						Name:  "cache-ttl",
+						Usage: "How long checked DNS results stay valid",
+						Value: dns.DEFAULT_CACHE_TTL,
+					},
+					&cli.BoolFlag{
+						Name:  "refresh",
+						Usage: "Re-check DNS servers even when the cache is still valid (with --check)",
+					},
+					&cli.BoolFlag{
+						Name:  "fail-if-none",
+						Usage: "Exit with code 2 when no DNS server can download any data",
+					},
+					&cli.StringFlag{
+						Name:  "keep",
+						Usage: "Save what was downloaded from each DNS server in `DIR`/<server>/ instead of discarding it",
+					},
+					&cli.StringFlag{
+						Name:  "max-bytes",
+						Usage: "Stop each download after this much data, e.g. 50MB; the speed is measured over the shorter time",
+					},
+				}, probeTimeoutFlags("check-timeout")...),
 				Action: func(cCtx *cli.Context) error {
 					// Validate the URL argument
 					if cCtx.Args().Len() < 1 {
-						fmt.Println("Error: URL is required")
-						return cli.ShowSubcommandHelp(cCtx)
+						return usageError(cCtx, "URL is required")
 					}
 
 					// Validate the provided URL
 					url := cCtx.Args().First()
 					if !dns.URLValidator(url) {
-						fmt.Println("Error: Invalid URL")
-						return cli.ShowSubcommandHelp(cCtx)
+						return usageError(cCtx, "invalid URL %q", url)
+					}
+					if cCtx.Int("timeout") <= 0 {
+						return usageError(cCtx, "timeout must be positive")
+					}
+					if _, err := common.ParseDataSize(cCtx.String("max-bytes")); err != nil {
+						return usageError(cCtx, "--max-bytes: %v", err)
+					}
+					if err := validateProbeTimeouts(cCtx, "check-timeout"); err != nil {
+						return err
 					}
 
 					// Call CheckWithURL with the current context
 					return dns.CheckWithURL(cCtx)
 				},
 			},
+			{
+				Name:      "watch",
+				Aliases:   []string{"w"},
+				Usage:     "Periodically re-checks URLs and runs hooks when the best DNS server changes or everything fails",
+				ArgsUsage: "<URL>...",
+				Description: `Examples:
+    403unlocker watch --interval 5m https://registry.npmjs.org
+    403unlocker watch --mode bestdns --webhook https://hooks.example.com/403 https://packages.gitlab.com/gitlab/gitlab-ce/packages/el/7/gitlab-ce-16.8.0-ce.0.el7.x86_64.rpm/download.rpm
+    403unlocker watch --exec 'logger "$UNLOCKER_MESSAGE"' --notify pkg.go.dev`,
+				Before: applyProfileDefaults,
+				Flags: append([]cli.Flag{
+					&cli.DurationFlag{
+						Name:    "interval",
+						Usage:   "Time between two rounds",
+						Value:   5 * time.Minute,
+						Aliases: []string{"i"},
+					},
+					&cli.StringFlag{
+						Name:    "mode",
+						Usage:   "What to run each round: check (status through each DNS) or bestdns (download speed through each DNS)",
+						Value:   watch.MODE_CHECK,
+						Aliases: []string{"m"},
+					},
+					&cli.IntFlag{
+						Name:    "timeout",
+						Usage:   "Download time per DNS server in seconds (bestdns mode)",
+						Value:   10,
+						Aliases: []string{"t"},
+					},
+					&cli.StringSliceFlag{
+						Name:  "exec",
+						Usage: "Shell command to run on every event; the event is passed in UNLOCKER_* environment variables",
+					},
+					&cli.StringSliceFlag{
+						Name:  "webhook",
+						Usage: "URL to POST every event to as JSON",
+					},
+					&cli.BoolFlag{
+						Name:  "notify",
+						Usage: "Show a desktop notification on every event",
+					},
+					&cli.IntFlag{
+						Name:  "count",
+						Usage: "Stop after this many rounds (0 runs until interrupted)",
+					},
+				}, probeTimeoutFlags("check-timeout")...),
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.Args().Len() < 1 {
+						return usageError(cCtx, "at least one URL is required")
+					}
+					for _, url := range cCtx.Args().Slice() {
+						switch cCtx.String("mode") {
+						case watch.MODE_CHECK:
+							if !check.DomainValidator(url) {
+								return usageError(cCtx, "invalid URL %q", url)
+							}
+						case watch.MODE_BESTDNS:
+							if !dns.URLValidator(url) {
+								return usageError(cCtx, "invalid URL %q", url)
+							}
+						default:
+							return usageError(cCtx, "invalid mode %q", cCtx.String("mode"))
+						}
+					}
+					if cCtx.Duration("interval") <= 0 {
+						return usageError(cCtx, "interval must be positive")
+					}
+					if err := validateProbeTimeouts(cCtx, "check-timeout"); err != nil {
+						return err
+					}
+					return watch.Watch(cCtx)
+				},
+			},
+			{
+				Name:      "tui",
+				Usage:     "Shows a live dashboard of every DNS server for a URL, with speed tests and keys to copy or apply the best one",
+				ArgsUsage: "<URL>",
+				Description: `Keys:
+    q quit, r re-run, s cycle the sort column (status, latency, speed),
+    c copy the best server to the clipboard, a write the best server to --resolv-conf
+
+Examples:
+    403unlocker tui pkg.go.dev
+    sudo 403unlocker tui --timeout 5 https://packages.gitlab.com/gitlab/gitlab-ce/packages/el/7/gitlab-ce-16.8.0-ce.0.el7.x86_64.rpm/download.rpm`,
+				Before: applyProfileDefaults,
+				Flags: append([]cli.Flag{
+					&cli.IntFlag{
+						Name:    "timeout",
+						Usage:   "Download time per working DNS server in seconds",
+						Value:   5,
+						Aliases: []string{"t"},
+					},
+					&cli.StringFlag{
+						Name:  "resolv-conf",
+						Usage: "File the apply key writes the best server to; the old file is kept as <file>.403unlocker.bak",
+						Value: tui.DEFAULT_RESOLV_CONF,
+					},
+				}, probeTimeoutFlags("check-timeout")...),
+				Action: func(cCtx *cli.Context) error {
+					if !check.DomainValidator(cCtx.Args().First()) {
+						return usageError(cCtx, "invalid URL %q", cCtx.Args().First())
+					}
+					if cCtx.Int("timeout") <= 0 {
+						return usageError(cCtx, "timeout must be positive")
+					}
+					if err := validateProbeTimeouts(cCtx, "check-timeout"); err != nil {
+						return err
+					}
+					return tui.Run(cCtx)
+				},
+			},
+			{
+				Name:  "serve",
+				Usage: "Runs 403unlocker as a long running service",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "metrics",
+						Usage: "Periodically probes targets and exposes the results as Prometheus metrics on /metrics",
+						Description: `Examples:
+    403unlocker serve metrics --check pkg.go.dev --check registry.npmjs.org
+    403unlocker serve metrics --listen :9403 --interval 10m --image alpine:3.20 --download https://packages.gitlab.com/gitlab/gitlab-ce/packages/el/7/gitlab-ce-16.8.0-ce.0.el7.x86_64.rpm/download.rpm`,
+						Before: applyProfileDefaults,
+						Flags: append([]cli.Flag{
+							&cli.StringFlag{
+								Name:    "listen",
+								Usage:   "Address to serve /metrics on",
+								Value:   metrics.DEFAULT_LISTEN,
+								Aliases: []string{"l"},
+							},
+							&cli.DurationFlag{
+								Name:    "interval",
+								Usage:   "Time between two probe rounds",
+								Value:   5 * time.Minute,
+								Aliases: []string{"i"},
+							},
+							&cli.IntFlag{
+								Name:    "timeout",
+								Usage:   "Download and pull time per server in seconds",
+								Value:   10,
+								Aliases: []string{"t"},
+							},
+							&cli.StringSliceFlag{
+								Name:  "check",
+								Usage: "Domain to check through every DNS server, like the check command",
+							},
+							&cli.StringSliceFlag{
+								Name:  "download",
+								Usage: "URL to benchmark through every DNS server, like the bestdns command",
+							},
+							&cli.StringSliceFlag{
+								Name:  "image",
+								Usage: "Docker image to pull from every registry, like the fastdocker command",
+							},
+							&cli.StringFlag{
+								Name:  "platform",
+								Usage: "Platform of the --image to measure, e.g. linux/arm64 (default: linux on this machine's architecture)",
+							},
+						}, probeTimeoutFlags("check-timeout")...),
+						Action: func(cCtx *cli.Context) error {
+							if len(cCtx.StringSlice("check"))+len(cCtx.StringSlice("download"))+len(cCtx.StringSlice("image")) == 0 {
+								return usageError(cCtx, "at least one --check, --download or --image target is required")
+							}
+							for _, target := range cCtx.StringSlice("check") {
+								if !check.DomainValidator(target) {
+									return usageError(cCtx, "invalid URL %q", target)
+								}
+							}
+							for _, target := range cCtx.StringSlice("download") {
+								if !dns.URLValidator(target) {
+									return usageError(cCtx, "invalid URL %q", target)
+								}
+							}
+							for _, image := range cCtx.StringSlice("image") {
+								if !docker.DockerImageValidator(image) {
+									return usageError(cCtx, "invalid docker image %q", image)
+								}
+							}
+							if cCtx.Duration("interval") <= 0 || cCtx.Int("timeout") <= 0 {
+								return usageError(cCtx, "interval and timeout must be positive")
+							}
+							if platform := cCtx.String("platform"); platform != "" {
+								if _, err := v1.ParsePlatform(platform); err != nil {
+									return usageError(cCtx, "--platform: %v", err)
+								}
+							}
+							if err := validateProbeTimeouts(cCtx, "check-timeout"); err != nil {
+								return err
+							}
+							return metrics.Serve(cCtx)
+						},
+					},
+					{
+						Name:  "api",
+						Usage: "Serves a REST API that runs check, bestdns and fastdocker on behalf of other machines",
+						Description: `Endpoints (POST, JSON body):
+    /check       {"url": "pkg.go.dev"}
+    /bestdns     {"url": "https://example.com/file.rpm", "timeout": 10, "check": true}
+    /fastdocker  {"image": "alpine:3.20", "timeout": 10, "platform": "linux/arm64"}
+
+Examples:
+    403unlocker serve api
+    403unlocker serve api --listen :9404 --token "$UNLOCKER_API_TOKEN"
+    curl -H "Authorization: Bearer $UNLOCKER_API_TOKEN" -d '{"url":"pkg.go.dev"}' http://office-probe:9404/check`,
+						Flags: append([]cli.Flag{
+							&cli.StringFlag{
+								Name:    "listen",
+								Usage:   "Address to serve the API on",
+								Value:   api.DEFAULT_LISTEN,
+								Aliases: []string{"l"},
+							},
+							&cli.StringFlag{
+								Name:    "token",
+								Usage:   "Bearer token clients must send; required unless --listen is a loopback address",
+								EnvVars: []string{"UNLOCKER_API_TOKEN"},
+							},
+							&cli.IntFlag{
+								Name:  "max-concurrent",
+								Usage: "Maximum number of probes running at once; further requests get 429",
+								Value: api.DEFAULT_MAX_CONCURRENT,
+							},
+						}, probeTimeoutFlags("check-timeout")...),
+						Action: func(cCtx *cli.Context) error {
+							if cCtx.Int("max-concurrent") < 1 {
+								return usageError(cCtx, "max-concurrent must be positive")
+							}
+							if err := validateProbeTimeouts(cCtx, "check-timeout"); err != nil {
+								return err
+							}
+							if cCtx.String("token") == "" && !api.IsLoopback(cCtx.String("listen")) {
+								return usageError(cCtx, "--token is required to listen on %s, which other hosts can reach", cCtx.String("listen"))
+							}
+							return api.Serve(cCtx)
+						},
+					},
+					{
+						Name:  "registry",
+						Usage: "Serves a local registry mirror that pulls from the fastest working registry in dockerRegistry.conf",
+						Description: `Every pull goes to the fastest registry of the last ranking and fails over to
+the next one when a registry errors, times out or serves content that does not
+match its digest. Point Docker at it with "registry-mirrors": ["http://localhost:5000"]
+in /etc/docker/daemon.json, or containerd with a hosts.toml for the mirror.
+
+Examples:
+    403unlocker serve registry
+    403unlocker serve registry --listen :5000 --cache /var/cache/403unlocker/blobs --rank-interval 30m`,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "listen",
+								Usage:   "Address to serve the mirror on",
+								Value:   mirror.DEFAULT_LISTEN,
+								Aliases: []string{"l"},
+							},
+							&cli.StringFlag{
+								Name:  "cache",
+								Usage: "Keep verified blobs in `DIR` and serve them from there (default: no cache)",
+							},
+							&cli.StringFlag{
+								Name:  "rank-image",
+								Usage: "Image pulled from every registry to rank them",
+								Value: mirror.DEFAULT_RANK_IMAGE,
+							},
+							&cli.DurationFlag{
+								Name:  "rank-interval",
+								Usage: "Time between rankings of the registries",
+								Value: mirror.DEFAULT_RANK_INTERVAL,
+							},
+							&cli.IntFlag{
+								Name:    "timeout",
+								Usage:   "Seconds a registry may take to answer before the next one is tried, and to pull the rank image",
+								Value:   mirror.DEFAULT_TIMEOUT,
+								Aliases: []string{"t"},
+							},
+							&cli.StringFlag{
+								Name:  "platform",
+								Usage: "Platform of the rank image, e.g. linux/arm64 (default: linux on this machine's architecture)",
+							},
+						},
+						Action: func(cCtx *cli.Context) error {
+							if !docker.DockerImageValidator(cCtx.String("rank-image")) {
+								return usageError(cCtx, "invalid --rank-image %q", cCtx.String("rank-image"))
+							}
+							if cCtx.Duration("rank-interval") <= 0 || cCtx.Int("timeout") <= 0 {
+								return usageError(cCtx, "rank-interval and timeout must be positive")
+							}
+							if platform := cCtx.String("platform"); platform != "" {
+								if _, err := v1.ParsePlatform(platform); err != nil {
+									return usageError(cCtx, "--platform: %v", err)
+								}
+							}
+							return mirror.Serve(cCtx)
+						},
+					},
+				},
+			},
+			{
+				Name:  "history",
+				Usage: "Shows uptime, median speed and trend per server from previous runs",
+				Description: `Examples:
+    403unlocker history
+    403unlocker history --kind bestdns --domain packages.gitlab.com --since 30d
+    403unlocker history --network current`,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "domain",
+						Usage:   "Only show runs against this domain (or docker image for fastdocker)",
+						Aliases: []string{"d"},
+					},
+					&cli.StringFlag{
+						Name:    "kind",
+						Usage:   "Only show runs of one command: check, bestdns or fastdocker",
+						Aliases: []string{"k"},
+					},
+					&cli.StringFlag{
+						Name:  "server",
+						Usage: "Only show one DNS server or registry",
+					},
+					&cli.StringFlag{
+						Name:  "network",
+						Usage: "Only show runs on the network with this ID (see config network), or \"current\"",
+					},
+					&cli.StringFlag{
+						Name:  "since",
+						Usage: "Start of the time range, as a date (2025-01-02), RFC 3339 time or age (7d, 36h)",
+					},
+					&cli.StringFlag{
+						Name:  "until",
+						Usage: "End of the time range, in the same formats as --since",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					switch cCtx.String("kind") {
+					case "", history.KIND_CHECK, history.KIND_BESTDNS, history.KIND_FASTDOCKER:
+						return history.ShowHistory(cCtx)
+					}
+					return usageError(cCtx, "invalid kind %q", cCtx.String("kind"))
+				},
+			},
+			{
+				Name:  "config",
+				Usage: "Manages 403unlocker configuration",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "network",
+						Usage: "Shows the fingerprint of the current network used to key cached results",
+						Action: func(cCtx *cli.Context) error {
+							fingerprint := network.Current(cCtx.Context)
+							fmt.Printf("Network ID:  %s\n", fingerprint.ID())
+							fmt.Printf("Gateway:     %s %s\n", fingerprint.Gateway, fingerprint.GatewayMAC)
+							fmt.Printf("Public IP:   %s\n", fingerprint.PublicIP)
+							fmt.Printf("ISP:         %s %s\n", fingerprint.ASN, fingerprint.ISP)
+							return nil
+						},
+					},
+					{
+						Name:  "profile",
+						Usage: "Manages named DNS/registry profiles",
+						Subcommands: []*cli.Command{
+							{
+								Name:      "create",
+								Usage:     "Creates a new profile",
+								ArgsUsage: "<name>",
+								Description: `Examples:
+    403unlocker config profile create office
+    403unlocker config profile create --from office --default timeout=20 ci`,
+								Flags: []cli.Flag{
+									&cli.StringFlag{
+										Name:  "from",
+										Usage: "Copy the DNS and registry lists from this profile",
+										Value: common.DEFAULT_PROFILE,
+									},
+									&cli.StringSliceFlag{
+										Name:    "default",
+										Usage:   "Flag default for this profile as key=value, e.g. timeout=15",
+										Aliases: []string{"d"},
+									},
+								},
+								Action: func(cCtx *cli.Context) error {
+									name := cCtx.Args().First()
+									if !profile.NameValidator(name) {
+										return usageError(cCtx, "a valid profile name is required")
+									}
+									defaults, err := profile.ParseDefaults(cCtx.StringSlice("default"))
+									if err != nil {
+										return err
+									}
+									if err := profile.ValidateDefaults(cCtx.App, defaults); err != nil {
+										return err
+									}
+									if err := profile.Create(baseConfig, name, cCtx.String("from"), defaults); err != nil {
+										return err
+									}
+									fmt.Printf("Created profile %s\n", name)
+									return nil
+								},
+							},
+							{
+								Name:      "use",
+								Usage:     "Makes a profile the active one, or the one used on the current network",
+								ArgsUsage: "<name>",
+								Flags: []cli.Flag{
+									&cli.BoolFlag{
+										Name:  "network",
+										Usage: "Use the profile whenever this network is detected, instead of everywhere",
+									},
+								},
+								Action: func(cCtx *cli.Context) error {
+									name := cCtx.Args().First()
+									if name == "" {
+										return usageError(cCtx, "profile name is required")
+									}
+									if cCtx.Bool("network") {
+										fingerprint := network.Current(cCtx.Context)
+										if fingerprint.ID() == network.UNKNOWN_NETWORK {
+											return fmt.Errorf("the current network could not be detected")
+										}
+										if err := profile.Bind(baseConfig, fingerprint.ID(), name); err != nil {
+											return err
+										}
+										fmt.Printf("Using profile %s on network %s (%s)\n", name, fingerprint.ID(), fingerprint)
+										return nil
+									}
+									if err := profile.Use(baseConfig, name); err != nil {
+										return err
+									}
+									fmt.Printf("Using profile %s\n", name)
+									return nil
+								},
+							},
+							{
+								Name:  "list",
+								Usage: "Lists all profiles",
+								Action: func(cCtx *cli.Context) error {
+									names, err := profile.List(baseConfig)
+									if err != nil {
+										return err
+									}
+									active := common.Config.(common.ProfileLocation).Name
+									for _, name := range names {
+										if name == active {
+											fmt.Printf("* %s\n", common.Colorize(common.Green, name))
+										} else {
+											fmt.Printf("  %s\n", name)
+										}
+									}
+									return nil
+								},
+							},
+						},
+					},
+				},
+			},
 		},
 	}
-	if err := app.Run(os.Args); err != nil {
-		log.Fatal(err)
+	setUsageErrors(app.Commands)
+	app.OnUsageError = onUsageError
+
+	// Interrupts cancel the context of every command, so probes stop and
+	// partial results are printed. A second interrupt kills the process.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	err := app.RunContext(ctx, os.Args)
+	stop()
+	if err != nil {
+		if errors.Is(err, common.ErrHomeNotSet) {
+			log.Printf("%v\nSet HOME or pass --config-dir (UNLOCKER_CONFIG_DIR) to choose where config files live.", err)
+		} else {
+			log.Println(err)
+		}
+		os.Exit(common.ExitCode(err))
+	}
+}
+
+// usageError shows the help of the current command and returns an
+// ErrInvalidInput error, so the command exits with EXIT_INVALID_INPUT.
+func usageError(cCtx *cli.Context, format string, args ...any) error {
+	if err := cli.ShowSubcommandHelp(cCtx); err != nil {
+		fmt.Println(err)
+	}
+	return fmt.Errorf("%w: %s", common.ErrInvalidInput, fmt.Sprintf(format, args...))
+}
+
+func onUsageError(cCtx *cli.Context, err error, isSubcommand bool) error {
+	return fmt.Errorf("%w: %v", common.ErrInvalidInput, err)
+}
+
+// setUsageErrors makes invalid flags of every command exit with EXIT_INVALID_INPUT.
+func setUsageErrors(commands []*cli.Command) {
+	for _, command := range commands {
+		command.OnUsageError = onUsageError
+		setUsageErrors(command.Subcommands)
 	}
 }
@@ -0,0 +1,175 @@
+package watch
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/salehborhani/403Unlocker-cli/internal/check"
+	"github.com/salehborhani/403Unlocker-cli/internal/common"
+	"github.com/salehborhani/403Unlocker-cli/internal/dns"
+	"github.com/salehborhani/403Unlocker-cli/internal/history"
+	"github.com/salehborhani/403Unlocker-cli/internal/notify"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// Modes of watch.
+	MODE_CHECK   = "check"
+	MODE_BESTDNS = "bestdns"
+)
+
+// State is what one round of probing found out about a target.
+type State struct {
+	Best    string
+	Working int
+	Total   int
+}
+
+// Tracker remembers the last state of every target and turns changes into events.
+type Tracker struct {
+	states map[string]State
+}
+
+// NewTracker returns a Tracker that has not seen any target yet.
+func NewTracker() *Tracker {
+	return &Tracker{states: make(map[string]State)}
+}
+
+// Best returns the best server last recorded for target.
+func (t *Tracker) Best(target string) string {
+	return t.states[target].Best
+}
+
+// Update records state for target and returns the events caused by the
+// transition from its previous state.
+func (t *Tracker) Update(target string, state State, now time.Time) []notify.Event {
+	previous, seen := t.states[target]
+	t.states[target] = state
+
+	event := notify.Event{Time: now, Target: target, Previous: previous.Best, Current: state.Best}
+	switch {
+	case state.Working == 0 && (!seen || previous.Working > 0):
+		event.Kind = notify.EVENT_ALL_FAILED
+		event.Message = fmt.Sprintf("%s: none of the %d DNS servers work", target, state.Total)
+	case !seen:
+		return nil
+	case previous.Working == 0 && state.Working > 0:
+		event.Kind = notify.EVENT_RECOVERED
+		event.Message = fmt.Sprintf("%s: %d DNS servers work again, best is %s", target, state.Working, state.Best)
+	case previous.Best != state.Best:
+		event.Kind = notify.EVENT_BEST_CHANGED
+		event.Message = fmt.Sprintf("%s: best DNS server changed from %s to %s", target, previous.Best, state.Best)
+	default:
+		return nil
+	}
+	return []notify.Event{event}
+}
+
+// Watch re-runs check or bestdns against every URL argument each interval and
+// notifies the configured hooks about state transitions until interrupted.
+func Watch(c *cli.Context) error {
+	ctx := c.Context
+
+	var notifiers notify.Multi
+	for _, command := range c.StringSlice("exec") {
+		notifiers = append(notifiers, notify.Command{Command: command})
+	}
+	for _, url := range c.StringSlice("webhook") {
+		notifiers = append(notifiers, notify.Webhook{URL: url})
+	}
+	if c.Bool("notify") {
+		notifiers = append(notifiers, notify.Desktop{})
+	}
+
+	dnsList, err := common.ReadOrDownloadConfig(common.DNS_CONFIG_FILE, common.DNS_CONFIG_URL)
+	if err != nil {
+		return err
+	}
+
+	mode := c.String("mode")
+	interval := c.Duration("interval")
+	timeout := time.Duration(c.Int("timeout")) * time.Second
+	timeouts := check.TimeoutsFlag(c, "check-timeout")
+	targets := c.Args().Slice()
+	tracker := NewTracker()
+
+	fmt.Printf("Watching %d URLs every %s in %s mode, press Ctrl-C to stop\n", len(targets), interval, mode)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for round := 1; ; round++ {
+		for _, target := range targets {
+			if ctx.Err() != nil {
+				break
+			}
+			state := probe(ctx, mode, target, dnsList, timeout, timeouts, tracker.Best(target))
+			now := time.Now()
+			if state.Working > 0 {
+				fmt.Printf("[%s] %s: best %s (%d/%d working)\n",
+					now.Format(time.DateTime), target, common.Colorize(common.Green, state.Best), state.Working, state.Total)
+			} else {
+				fmt.Printf("[%s] %s: %s (0/%d)\n",
+					now.Format(time.DateTime), target, common.Colorize(common.Red, "nothing works"), state.Total)
+			}
+
+			for _, event := range tracker.Update(target, state, now) {
+				fmt.Println(common.Colorize(common.Yellow, event.Message))
+				if err := notifiers.Notify(ctx, event); err != nil {
+					fmt.Println("Warning: notification failed:", err)
+				}
+			}
+		}
+
+		if count := c.Int("count"); count > 0 && round >= count {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			fmt.Println("\nStopped watching.")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe runs one round of mode against target, downloading for timeout in
+// bestdns mode and checking with timeouts in check mode. In check mode the previous
+// best server is kept as long as it still works, so small latency differences
+// between rounds do not cause a flood of events.
+func probe(ctx context.Context, mode, target string, dnsList []string, timeout time.Duration, timeouts common.Timeouts, previousBest string) State {
+	started := time.Now()
+	state := State{Total: len(dnsList)}
+
+	if mode == MODE_BESTDNS {
+		sizes := dns.Benchmark(ctx, target, dnsList, timeout, common.DownloadOptions{}, nil)
+		dns.RecordBenchmark(ctx, target, started, timeout, sizes)
+		for _, size := range sizes {
+			if size > 0 {
+				state.Working++
+			}
+		}
+		state.Best, _ = dns.Best(sizes)
+		return state
+	}
+
+	url := check.EnsureHTTPS(target)
+	results := check.Probe(ctx, url, dnsList, timeouts, nil)
+	check.RecordHistory(ctx, history.KIND_CHECK, url, started, results)
+	var fastest time.Duration
+	previousWorks := false
+	for _, result := range results {
+		if !result.OK() {
+			continue
+		}
+		state.Working++
+		previousWorks = previousWorks || result.Server == previousBest
+		if state.Best == "" || result.Latency < fastest || (result.Latency == fastest && result.Server < state.Best) {
+			state.Best, fastest = result.Server, result.Latency
+		}
+	}
+	if previousWorks {
+		state.Best = previousBest
+	}
+	return state
+}
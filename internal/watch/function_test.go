@@ -0,0 +1,45 @@
+package watch
+
+import (
+	"testing"
+	"time"
+
+	"github.com/salehborhani/403Unlocker-cli/internal/notify"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrackerUpdate(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		state    State
+		expected string
+	}{
+		{"First round works", State{Best: "10.202.10.202", Working: 3, Total: 5}, ""},
+		{"Same best", State{Best: "10.202.10.202", Working: 2, Total: 5}, ""},
+		{"Best changed", State{Best: "178.22.122.100", Working: 2, Total: 5}, notify.EVENT_BEST_CHANGED},
+		{"Everything fails", State{Working: 0, Total: 5}, notify.EVENT_ALL_FAILED},
+		{"Still failing", State{Working: 0, Total: 5}, ""},
+		{"Recovered", State{Best: "10.202.10.202", Working: 1, Total: 5}, notify.EVENT_RECOVERED},
+	}
+
+	tracker := NewTracker()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := tracker.Update("registry.npmjs.org", tt.state, now)
+			if tt.expected == "" {
+				assert.Empty(t, events, "Test case: %s", tt.name)
+				return
+			}
+			assert.Len(t, events, 1, "Test case: %s", tt.name)
+			assert.Equal(t, tt.expected, events[0].Kind, "Test case: %s", tt.name)
+			assert.Equal(t, tt.state.Best, events[0].Current, "Test case: %s", tt.name)
+		})
+	}
+}
+
+func TestTrackerFailingFromStart(t *testing.T) {
+	events := NewTracker().Update("pkg.go.dev", State{Total: 24}, time.Now())
+	assert.Len(t, events, 1)
+	assert.Equal(t, notify.EVENT_ALL_FAILED, events[0].Kind)
+}